@@ -0,0 +1,179 @@
+package btd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoAuditKey = errors.New("signing audit log requires an HMAC key")
+
+	// Records every successful issuance, disabled unless configured
+	SigningAudit SigningAuditLogger = NoopSigningAuditLogger{}
+)
+
+// A SigningAuditEntry describes a single batch of signed tokens. Only hashes
+// of the signed points are kept, which are enough to match an entry against a
+// token that turns up later without retaining the signatures themselves.
+type SigningAuditEntry struct {
+	Time        time.Time `json:"time"`
+	RemoteAddr  string    `json:"remote_addr"`
+	KeyVersion  string    `json:"key_version"`
+	TokenCount  int       `json:"token_count"`
+	TokenHashes []string  `json:"signed_token_sha256"`
+	MAC         string    `json:"mac,omitempty"`
+}
+
+type SigningAuditLogger interface {
+	Log(entry SigningAuditEntry) error
+}
+
+// NewSigningAuditEntry builds an audit entry for the marshaled signed points
+// that are about to be returned to a client.
+func NewSigningAuditEntry(remoteAddr, keyVersion string, sigs [][]byte) SigningAuditEntry {
+	hashes := make([]string, len(sigs))
+	for i := 0; i < len(sigs); i++ {
+		sum := sha256.Sum256(sigs[i])
+		hashes[i] = hex.EncodeToString(sum[:])
+	}
+	return SigningAuditEntry{
+		Time:        time.Now().UTC(),
+		RemoteAddr:  remoteAddr,
+		KeyVersion:  keyVersion,
+		TokenCount:  len(sigs),
+		TokenHashes: hashes,
+	}
+}
+
+// computeMAC returns the hex-encoded HMAC-SHA256 over the JSON encoding of
+// the entry with its MAC field cleared.
+func (e SigningAuditEntry) computeMAC(key []byte) (string, error) {
+	e.MAC = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifySigningAuditEntry checks that an entry read back from the log has not
+// been modified since it was written.
+func VerifySigningAuditEntry(entry SigningAuditEntry, key []byte) bool {
+	expected, err := entry.computeMAC(key)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal([]byte(expected), []byte(entry.MAC))
+}
+
+type NoopSigningAuditLogger struct{}
+
+func (NoopSigningAuditLogger) Log(entry SigningAuditEntry) error { return nil }
+
+// FileSigningAuditLogger appends MAC'd entries as newline-delimited JSON. Once
+// the file grows past maxSize bytes it is moved aside to path + ".N", for the
+// lowest N that isn't taken yet, and a new file is started. Rotated files are
+// never overwritten or removed. A maxSize of 0 disables rotation.
+type FileSigningAuditLogger struct {
+	lock    sync.Mutex
+	path    string
+	key     []byte
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+func NewFileSigningAuditLogger(path string, key []byte, maxSize int64) (*FileSigningAuditLogger, error) {
+	if len(key) == 0 {
+		return nil, ErrNoAuditKey
+	}
+	l := &FileSigningAuditLogger{path: path, key: key, maxSize: maxSize}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *FileSigningAuditLogger) open() error {
+	f, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// rotate moves the log aside and starts a new one. The old file is only closed
+// once the new one is open, so a failed rotation keeps logging to the old file.
+func (l *FileSigningAuditLogger) rotate() error {
+	rotated, err := nextRotatedPath(l.path)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+	old := l.file
+	if err := l.open(); err != nil {
+		os.Rename(rotated, l.path)
+		return err
+	}
+	return old.Close()
+}
+
+// nextRotatedPath returns path + ".N" for the lowest N >= 1 that doesn't exist
+func nextRotatedPath(path string) (string, error) {
+	for n := 1; ; n++ {
+		rotated := fmt.Sprintf("%s.%d", path, n)
+		_, err := os.Lstat(rotated)
+		if os.IsNotExist(err) {
+			return rotated, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+func (l *FileSigningAuditLogger) Log(entry SigningAuditEntry) error {
+	mac, err := entry.computeMAC(l.key)
+	if err != nil {
+		return err
+	}
+	entry.MAC = mac
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+func (l *FileSigningAuditLogger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,233 @@
+package btd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/privacypass/challenge-bypass-server/crypto"
+)
+
+var testAuditKey = []byte("audit-test-key")
+
+func readAuditLog(t *testing.T, path string) []SigningAuditEntry {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var entries []SigningAuditEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry SigningAuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("audit log line is not valid JSON: %v", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// Tests that each signing operation produces one verifiable log line
+func TestSigningAuditLogIncrement(t *testing.T) { crypto.HandleTest(t, "increment", signingAuditLog) }
+func signingAuditLog(t *testing.T, h2cObj crypto.H2CObject) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := NewFileSigningAuditLogger(path, testAuditKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, G, H, err := fakeKeyAndCommitments(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		req, _, _, _, err := makeTokenIssueRequest(h2cObj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := ApproveTokens(*req, key, "1.1", G, H)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = logger.Log(NewSigningAuditEntry("127.0.0.1:1234", resp.Version, resp.Sigs))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger.Close()
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 10 {
+		t.Fatalf("expected 10 audit entries, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if !VerifySigningAuditEntry(entry, testAuditKey) {
+			t.Fatal("audit entry MAC did not verify")
+		}
+		if entry.TokenCount != 10 || len(entry.TokenHashes) != 10 {
+			t.Fatalf("audit entry recorded %d tokens and %d hashes", entry.TokenCount, len(entry.TokenHashes))
+		}
+	}
+
+	// tampering with an entry must be detected
+	entries[0].TokenCount = 1
+	if VerifySigningAuditEntry(entries[0], testAuditKey) {
+		t.Fatal("modified audit entry still verified")
+	}
+	if VerifySigningAuditEntry(entries[1], []byte("wrong key")) {
+		t.Fatal("audit entry verified with the wrong key")
+	}
+}
+
+// Tests that every rotation keeps the entries of the earlier log files
+func TestSigningAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// every entry is larger than this, so each one after the first rotates
+	logger, err := NewFileSigningAuditLogger(path, testAuditKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		err = logger.Log(NewSigningAuditEntry("127.0.0.1:1234", "1.0", [][]byte{[]byte(strconv.Itoa(i))}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	logger.Close()
+
+	for i, p := range []string{path + ".1", path + ".2", path + ".3", path} {
+		entries := readAuditLog(t, p)
+		if len(entries) != 1 {
+			t.Fatalf("expected one entry in %s, got %d", p, len(entries))
+		}
+		sum := sha256.Sum256([]byte(strconv.Itoa(i)))
+		if entries[0].TokenHashes[0] != hex.EncodeToString(sum[:]) {
+			t.Errorf("%s holds the wrong entry", p)
+		}
+	}
+}
+
+// Tests that a rotation that fails leaves the current log file open
+func TestSigningAuditLogRotationFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "audit")
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	logger, err := NewFileSigningAuditLogger(filepath.Join(dir, "audit.log"), testAuditKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = logger.Log(NewSigningAuditEntry("127.0.0.1:1234", "1.0", [][]byte{[]byte("0")})); err != nil {
+		t.Fatal(err)
+	}
+
+	// the log can't be renamed once its directory is gone
+	if err = os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = logger.Log(NewSigningAuditEntry("127.0.0.1:1234", "1.0", [][]byte{[]byte("1")})); err == nil {
+		t.Fatal("expected the rotation to fail")
+	}
+	if err = logger.Close(); err != nil {
+		t.Fatalf("log file was not left open after a failed rotation: %v", err)
+	}
+}
+
+// Tests that HandleIssue writes an audit entry for the tokens it returns
+func TestHandleIssueSigningAuditIncrement(t *testing.T) {
+	crypto.HandleTest(t, "increment", handleIssueSigningAudit)
+}
+func handleIssueSigningAudit(t *testing.T, h2cObj crypto.H2CObject) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	logger, err := NewFileSigningAuditLogger(path, testAuditKey, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(previous SigningAuditLogger) { SigningAudit = previous }(SigningAudit)
+	SigningAudit = logger
+
+	key, G, H, err := fakeKeyAndCommitments(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _, _, _, err := makeTokenIssueRequest(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	clientConn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	serverConn, err := listener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = HandleIssue(serverConn, *req, key, "1.1", G, H, 10)
+	serverConn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Close()
+
+	resp, err := ioutil.ReadAll(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	respJson, err := base64.StdEncoding.DecodeString(string(resp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issued IssuedTokenResponse
+	if err = json.Unmarshal(respJson, &issued); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readAuditLog(t, path)
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 audit entry, got %d", len(entries))
+	}
+	entry := entries[0]
+	if !VerifySigningAuditEntry(entry, testAuditKey) {
+		t.Error("audit entry MAC did not verify")
+	}
+	if entry.RemoteAddr != clientConn.LocalAddr().String() || entry.KeyVersion != "1.1" {
+		t.Errorf("audit entry recorded remote %s and key version %s", entry.RemoteAddr, entry.KeyVersion)
+	}
+	if entry.TokenCount != len(issued.Sigs) || len(entry.TokenHashes) != len(issued.Sigs) {
+		t.Fatalf("audit entry recorded %d tokens for %d signatures", entry.TokenCount, len(issued.Sigs))
+	}
+	for i, sig := range issued.Sigs {
+		sum := sha256.Sum256(sig)
+		if entry.TokenHashes[i] != hex.EncodeToString(sum[:]) {
+			t.Errorf("hash %d in the audit entry doesn't match the signed token", i)
+		}
+	}
+}
+
+func TestSigningAuditLogRequiresKey(t *testing.T) {
+	_, err := NewFileSigningAuditLogger(filepath.Join(t.TempDir(), "audit.log"), nil, 0)
+	if err != ErrNoAuditKey {
+		t.Fatalf("expected ErrNoAuditKey, got %v", err)
+	}
+}
@@ -22,12 +22,14 @@ import (
 	"errors"
 	"math/big"
 	"strings"
+	"sync"
 
 	"golang.org/x/crypto/sha3"
 )
 
 var (
-	ErrUnequalPointCounts = errors.New("batch proof had unequal numbers of points")
+	ErrUnequalPointCounts  = errors.New("batch proof had unequal numbers of points")
+	ErrMalformedBatchProof = errors.New("batch proof is missing its encoded proof")
 
 	BATCH_PROOF_RESP_STR = "batch-proof="
 )
@@ -40,6 +42,12 @@ type BatchProof struct {
 }
 
 func NewBatchProof(hash crypto.Hash, g, h *Point, m []*Point, z []*Point, x *big.Int) (*BatchProof, error) {
+	return NewBatchProofParallel(hash, g, h, m, z, x, 1)
+}
+
+// NewBatchProofParallel returns the same proof as NewBatchProof, computing the
+// composites on up to workers goroutines with ComputeCompositesParallel.
+func NewBatchProofParallel(hash crypto.Hash, g, h *Point, m []*Point, z []*Point, x *big.Int, workers int) (*BatchProof, error) {
 	if len(m) != len(z) {
 		return nil, ErrUnequalPointCounts
 	}
@@ -47,7 +55,7 @@ func NewBatchProof(hash crypto.Hash, g, h *Point, m []*Point, z []*Point, x *big
 	// The underlying proof and validation steps will do consistency checks.
 	curve := g.Curve
 
-	compositeM, compositeZ, C, err := ComputeComposites(hash, curve, g, h, m, z)
+	compositeM, compositeZ, C, err := ComputeCompositesParallel(hash, curve, g, h, m, z, workers)
 	if err != nil {
 		return nil, err
 	}
@@ -64,8 +72,80 @@ func NewBatchProof(hash crypto.Hash, g, h *Point, m []*Point, z []*Point, x *big
 }
 
 func ComputeComposites(hash crypto.Hash, curve elliptic.Curve, G, Y *Point, P, Q []*Point) (*Point, *Point, [][]byte, error) {
+	C, err := compositeScalars(hash, curve, G, Y, P, Q)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	Mx, My, Zx, Zy := new(big.Int), new(big.Int), new(big.Int), new(big.Int)
+	for i := 0; i < len(P); i++ {
+		// cM = c[i]M[i]
+		cMx, cMy := curve.ScalarMult(P[i].X, P[i].Y, C[i])
+		// cZ = c[i]Z[i]
+		cZx, cZy := curve.ScalarMult(Q[i].X, Q[i].Y, C[i])
+		// Accumulate
+		Mx, My = curve.Add(cMx, cMy, Mx, My)
+		Zx, Zy = curve.Add(cZx, cZy, Zx, Zy)
+	}
+	compositeM := &Point{Curve: curve, X: Mx, Y: My}
+	compositeZ := &Point{Curve: curve, X: Zx, Y: Zy}
+
+	return compositeM, compositeZ, C, nil
+}
+
+// ComputeCompositesParallel returns the same composites as ComputeComposites,
+// splitting the scalar multiplications across up to workers goroutines. Each
+// worker sums a contiguous range of the batch and the partial sums are added
+// together at the end.
+func ComputeCompositesParallel(hash crypto.Hash, curve elliptic.Curve, G, Y *Point, P, Q []*Point, workers int) (*Point, *Point, [][]byte, error) {
+	if workers > len(P) {
+		workers = len(P)
+	}
+	if workers <= 1 {
+		return ComputeComposites(hash, curve, G, Y, P, Q)
+	}
+
+	// All of c_1, ..., c_n come from the PRNG in order before any work is
+	// split up, so the result doesn't depend on scheduling
+	C, err := compositeScalars(hash, curve, G, Y, P, Q)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	partials := make([][4]*big.Int, workers)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			defer wg.Done()
+			Mx, My, Zx, Zy := new(big.Int), new(big.Int), new(big.Int), new(big.Int)
+			for i := w * len(P) / workers; i < (w+1)*len(P)/workers; i++ {
+				cMx, cMy := curve.ScalarMult(P[i].X, P[i].Y, C[i])
+				cZx, cZy := curve.ScalarMult(Q[i].X, Q[i].Y, C[i])
+				Mx, My = curve.Add(cMx, cMy, Mx, My)
+				Zx, Zy = curve.Add(cZx, cZy, Zx, Zy)
+			}
+			partials[w] = [4]*big.Int{Mx, My, Zx, Zy}
+		}(w)
+	}
+	wg.Wait()
+
+	Mx, My, Zx, Zy := new(big.Int), new(big.Int), new(big.Int), new(big.Int)
+	for _, partial := range partials {
+		Mx, My = curve.Add(partial[0], partial[1], Mx, My)
+		Zx, Zy = curve.Add(partial[2], partial[3], Zx, Zy)
+	}
+	compositeM := &Point{Curve: curve, X: Mx, Y: My}
+	compositeZ := &Point{Curve: curve, X: Zx, Y: Zy}
+
+	return compositeM, compositeZ, C, nil
+}
+
+// compositeScalars derives the coefficients c_1, ..., c_n used to combine the
+// batch into a single pair of points.
+func compositeScalars(hash crypto.Hash, curve elliptic.Curve, G, Y *Point, P, Q []*Point) ([][]byte, error) {
 	if len(P) != len(Q) {
-		return nil, nil, nil, ErrUnequalPointCounts
+		return nil, ErrUnequalPointCounts
 	}
 
 	// seed = H(G, Y, [P], [Q])
@@ -91,27 +171,15 @@ func ComputeComposites(hash crypto.Hash, curve elliptic.Curve, G, Y *Point, P, Q
 	// (z_1^c_1)(z_2^c_2) = [(m_1^c_1)(m_2^c_2)]^x
 	// This generalizes to produce composite elements for the entire batch that
 	// can be compared to the public key in the standard two-point DLEQ proof.
-
-	Mx, My, Zx, Zy := new(big.Int), new(big.Int), new(big.Int), new(big.Int)
 	C := make([][]byte, len(P))
 	for i := 0; i < len(P); i++ {
 		ci, _, err := randScalar(curve, prng)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, err
 		}
-		// cM = c[i]M[i]
-		cMx, cMy := curve.ScalarMult(P[i].X, P[i].Y, ci)
-		// cZ = c[i]Z[i]
-		cZx, cZy := curve.ScalarMult(Q[i].X, Q[i].Y, ci)
-		// Accumulate
-		Mx, My = curve.Add(cMx, cMy, Mx, My)
-		Zx, Zy = curve.Add(cZx, cZy, Zx, Zy)
 		C[i] = ci
 	}
-	compositeM := &Point{Curve: curve, X: Mx, Y: My}
-	compositeZ := &Point{Curve: curve, X: Zx, Y: Zy}
-
-	return compositeM, compositeZ, C, nil
+	return C, nil
 }
 
 func (b *BatchProof) IsComplete() bool {
@@ -177,15 +245,25 @@ func UnmarshalBatchProof(curve elliptic.Curve, data []byte) (*Proof, error) {
 	// TODO: do it better than interfaces
 	bpJsonBytes := []byte(dataStr)
 	var bpDat map[string]interface{}
-	json.Unmarshal(bpJsonBytes, &bpDat)
+	err := json.Unmarshal(bpJsonBytes, &bpDat)
+	if err != nil {
+		return nil, err
+	}
 
 	// Have to decode base64 proof separately
-	prBytes, err := b64.StdEncoding.DecodeString(bpDat["P"].(string))
+	prB64, ok := bpDat["P"].(string)
+	if !ok {
+		return nil, ErrMalformedBatchProof
+	}
+	prBytes, err := b64.StdEncoding.DecodeString(prB64)
 	if err != nil {
 		return nil, err
 	}
 	ep := &Base64Proof{}
-	json.Unmarshal(prBytes, ep)
+	err = json.Unmarshal(prBytes, ep)
+	if err != nil {
+		return nil, err
+	}
 	proof, err := ep.DecodeProof(curve)
 	if err != nil {
 		return nil, err
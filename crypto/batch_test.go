@@ -1,11 +1,14 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/elliptic"
 	"crypto/rand"
 	_ "crypto/sha256"
 	"math/big"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -140,3 +143,128 @@ func TestMarshalBatchProofP256(t *testing.T) {
 		t.Fatal("Failed to verify unmarshaled batch proof")
 	}
 }
+
+// Generates a key, commitment and n pairs of points sharing its discrete log
+func generateBatchInputs(curve elliptic.Curve, n int) (*Point, *Point, []*Point, []*Point, *big.Int, error) {
+	x, _, _, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	_, Gx, Gy, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, nil, nil, nil, nil, err
+	}
+	G := &Point{Curve: curve, X: Gx, Y: Gy}
+	Hx, Hy := curve.ScalarMult(Gx, Gy, x)
+	H := &Point{Curve: curve, X: Hx, Y: Hy}
+
+	M := make([]*Point, n)
+	Z := make([]*Point, n)
+	for i := 0; i < n; i++ {
+		_, Mx, My, err := elliptic.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+		M[i] = &Point{Curve: curve, X: Mx, Y: My}
+		Zx, Zy := curve.ScalarMult(Mx, My, x)
+		Z[i] = &Point{Curve: curve, X: Zx, Y: Zy}
+	}
+	return G, H, M, Z, new(big.Int).SetBytes(x), nil
+}
+
+func BenchmarkNewBatchProofSingle(b *testing.B) {
+	G, H, M, Z, x, err := generateBatchInputs(elliptic.P256(), 1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := NewBatchProof(crypto.SHA256, G, H, M, Z, x); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Tests that splitting the composites across workers doesn't change them
+func TestComputeCompositesParallelP256(t *testing.T) {
+	curve := elliptic.P256()
+	G, H, M, Z, _, err := generateBatchInputs(curve, 37)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cM, cZ, C, err := ComputeComposites(crypto.SHA256, curve, G, H, M, Z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{1, 2, 4, 8, 100} {
+		pM, pZ, pC, err := ComputeCompositesParallel(crypto.SHA256, curve, G, H, M, Z, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pM.X.Cmp(cM.X) != 0 || pM.Y.Cmp(cM.Y) != 0 || pZ.X.Cmp(cZ.X) != 0 || pZ.Y.Cmp(cZ.Y) != 0 {
+			t.Fatalf("%d workers produced different composites", workers)
+		}
+		for i := range C {
+			if !bytes.Equal(C[i], pC[i]) {
+				t.Fatalf("%d workers produced a different c_%d", workers, i)
+			}
+		}
+	}
+
+	if _, _, _, err = ComputeCompositesParallel(crypto.SHA256, curve, G, H, M, Z[1:], 4); err != ErrUnequalPointCounts {
+		t.Fatalf("expected ErrUnequalPointCounts, got %v", err)
+	}
+}
+
+func BenchmarkComputeComposites100(b *testing.B) {
+	benchmarkComputeComposites(b, func(G, H *Point, M, Z []*Point) error {
+		_, _, _, err := ComputeComposites(crypto.SHA256, elliptic.P256(), G, H, M, Z)
+		return err
+	})
+}
+func BenchmarkComputeCompositesParallel100(b *testing.B) {
+	benchmarkComputeComposites(b, func(G, H *Point, M, Z []*Point) error {
+		_, _, _, err := ComputeCompositesParallel(crypto.SHA256, elliptic.P256(), G, H, M, Z, runtime.NumCPU())
+		return err
+	})
+}
+func benchmarkComputeComposites(b *testing.B, compute func(G, H *Point, M, Z []*Point) error) {
+	G, H, M, Z, _, err := generateBatchInputs(elliptic.P256(), 100)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := compute(G, H, M, Z); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Fuzzes the parsing of batch proofs as they are received by clients
+func FuzzUnmarshalBatchProof(f *testing.F) {
+	bp, err := generateValidBatchProof(elliptic.P256())
+	if err != nil {
+		f.Fatal(err)
+	}
+	respBytes, err := bp.MarshalForResp()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(respBytes)
+	f.Add([]byte(strings.TrimPrefix(string(respBytes), BATCH_PROOF_RESP_STR)))
+	f.Add([]byte(BATCH_PROOF_RESP_STR))
+	f.Add([]byte(`{"P":1}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		defer func() {
+			if r := recover(); r != nil {
+				t.Fatalf("UnmarshalBatchProof panicked on %q: %v", data, r)
+			}
+		}()
+		proof, err := UnmarshalBatchProof(elliptic.P256(), data)
+		if err == nil && (proof.R == nil || proof.C == nil) {
+			t.Fatalf("UnmarshalBatchProof returned an incomplete proof for %q", data)
+		}
+	})
+}
@@ -202,21 +202,20 @@ func randScalar(curve elliptic.Curve, rand io.Reader) ([]byte, *big.Int, error)
 // of enabling DLEQ proof batching and returns as a point representation.
 // Perform this sanity check to make sure that commitments work properly.
 //
-// This function only supports commitments from P256-SHA256 for now
-func RetrieveCommPoints(GBytes, HBytes, key []byte) (*Point, *Point, error) {
-	G := &Point{Curve: elliptic.P256(), X: nil, Y: nil}
+// The curve must be the one the key was generated on (P-256, P-384 or P-521)
+func RetrieveCommPoints(curve elliptic.Curve, GBytes, HBytes, key []byte) (*Point, *Point, error) {
+	G := &Point{Curve: curve, X: nil, Y: nil}
 	err := G.Unmarshal(G.Curve, GBytes)
 	if err != nil {
 		return nil, nil, err
 	}
-	H := &Point{Curve: elliptic.P256(), X: nil, Y: nil}
+	H := &Point{Curve: curve, X: nil, Y: nil}
 	err = H.Unmarshal(H.Curve, HBytes)
 	if err != nil {
 		return nil, nil, err
 	}
-	curve := elliptic.P256()
 	chkHX, chkHY := curve.ScalarMult(G.X, G.Y, key)
-	chkH := &Point{Curve: elliptic.P256(), X: chkHX, Y: chkHY}
+	chkH := &Point{Curve: curve, X: chkHX, Y: chkHY}
 	hash := crypto.SHA256
 	chkHash := hash.New()
 	_, err = chkHash.Write(chkH.Marshal())
@@ -162,3 +162,42 @@ func BenchmarkDecompression(b *testing.B) {
 		}
 	}
 }
+
+func TestRetrieveCommPointsP384(t *testing.T) {
+	curveParams := &CurveParams{Curve: "p384", Hash: "sha384", Method: "increment"}
+	h2cObj, err := curveParams.GetH2CObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := randScalar(h2cObj.Curve(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, G, err := NewRandomPoint(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Hx, Hy := h2cObj.Curve().ScalarMult(G.X, G.Y, key)
+	H := &Point{Curve: h2cObj.Curve(), X: Hx, Y: Hy}
+
+	chkG, chkH, err := RetrieveCommPoints(elliptic.P384(), G.Marshal(), H.Marshal(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chkG.X.Cmp(G.X) != 0 || chkH.X.Cmp(H.X) != 0 {
+		t.Fatal("retrieved commitment points did not match")
+	}
+
+	_, _, err = RetrieveCommPoints(elliptic.P256(), G.Marshal(), H.Marshal(), key)
+	if err == nil {
+		t.Fatal("P-384 commitment was accepted as a P-256 commitment")
+	}
+	otherKey, _, err := randScalar(h2cObj.Curve(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = RetrieveCommPoints(elliptic.P384(), G.Marshal(), H.Marshal(), otherKey)
+	if err != ErrCommSanityCheck {
+		t.Fatalf("expected ErrCommSanityCheck, got %v", err)
+	}
+}
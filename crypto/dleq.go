@@ -142,8 +142,17 @@ func (pr *Proof) Verify() bool {
 	H.Write(pr.Z.Marshal())
 	H.Write(elliptic.Marshal(curve, Ax, Ay))
 	H.Write(elliptic.Marshal(curve, Bx, By))
-	c := H.Sum(nil)
-	return hmac.Equal(pr.C.Bytes(), c)
+	c := new(big.Int).SetBytes(H.Sum(nil))
+	c.Mod(c, curve.Params().N)
+
+	// NewProof reduces c mod q, and Bytes() drops leading zeros, so compare
+	// fixed-length encodings of the reduced values
+	N := curve.Params().N
+	if pr.C.Sign() < 0 || pr.C.Cmp(N) >= 0 {
+		return false
+	}
+	byteLen := (N.BitLen() + 7) >> 3
+	return hmac.Equal(pr.C.FillBytes(make([]byte, byteLen)), c.FillBytes(make([]byte, byteLen)))
 }
 
 // Base64 encode the fields of the DLEQ proof for sending back to client
@@ -94,6 +94,36 @@ func TestValidProof(t *testing.T) {
 	}
 }
 
+// Tests that a proof whose c has leading zero bytes verifies. About one proof
+// in 256 has one, so proofs are created until one turns up.
+func TestValidProofShortChallenge(t *testing.T) {
+	h2cObj := getCurveParamsP256(t)
+	curve := h2cObj.Curve()
+	x, G, M, err := setup(curve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Hx, Hy := curve.ScalarMult(G.X, G.Y, x)
+	H := &Point{Curve: curve, X: Hx, Y: Hy}
+	Zx, Zy := curve.ScalarMult(M.X, M.Y, x)
+	Z := &Point{Curve: curve, X: Zx, Y: Zy}
+
+	for i := 0; i < 5000; i++ {
+		proof, err := NewProof(h2cObj.Hash(), G, H, M, Z, new(big.Int).SetBytes(x))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(proof.C.Bytes()) == 32 {
+			continue
+		}
+		if !proof.Verify() {
+			t.Fatalf("proof with a %d byte c was invalid", len(proof.C.Bytes()))
+		}
+		return
+	}
+	t.Fatal("no proof with leading zeros in c was created")
+}
+
 func TestInvalidProof(t *testing.T) {
 	h2cObj := getCurveParamsP256(t)
 	curve := h2cObj.Curve()
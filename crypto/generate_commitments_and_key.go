@@ -50,7 +50,8 @@ func main() {
 		curve = "p521"
 		hash = "sha512"
 	default:
-		fmt.Errorf("Unsupported curve choice made: %v", curveInPEM)
+		fmt.Printf("Unsupported curve choice made: %v\n", curveInPEM.Params().Name)
+		return
 	}
 
 	curveParams := &crypto.CurveParams{Curve: curve, Hash: hash, Method: method}
@@ -3,6 +3,7 @@ package crypto
 import (
 	"crypto"
 	"crypto/elliptic"
+	_ "crypto/sha512" // registers SHA-384 and SHA-512 for P-384 and P-521
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -14,11 +15,14 @@ var (
 )
 
 type h2cMethod string
+type keyDerivation string
 
 const (
 	INC_ITER = 20
 	H2C_SWU  = h2cMethod("swu")
 	H2C_INC  = h2cMethod("increment")
+	KDF_HMAC = keyDerivation("hmac")
+	KDF_HKDF = keyDerivation("hkdf")
 )
 
 type H2CObject interface {
@@ -26,22 +30,38 @@ type H2CObject interface {
 	Curve() elliptic.Curve
 	Hash() crypto.Hash
 	Method() string
+	KeyDerivation() string
 }
 
 type CurveParams struct {
 	Curve  string `json:"curve"`
 	Hash   string `json:"hash"`
 	Method string `json:"method"`
+	// KeyDerivation selects how redemption keys are derived, "hmac" (the
+	// default) or "hkdf"
+	KeyDerivation string `json:"key_derivation,omitempty"`
 }
 
-// GetH2CObj parses a map of curve parameters for the correct settings
+// GetH2CObj parses a map of curve parameters for the correct settings. The
+// server only issues P-256 tokens, so the P-384 and P-521 settings are for
+// clients and other users of this package.
 func (curveParams *CurveParams) GetH2CObj() (H2CObject, error) {
+	kdf := keyDerivation(curveParams.KeyDerivation)
+	if kdf == "" {
+		kdf = KDF_HMAC
+	}
+	if kdf != KDF_HMAC && kdf != KDF_HKDF {
+		return nil, fmt.Errorf("%s, key derivation: %s",
+			ErrIncompatibleCurveParams.Error(), curveParams.KeyDerivation)
+	}
+
 	switch curveParams.Curve {
 	case "p256":
 		params := &h2c{
 			curve: elliptic.P256(),
 			hash:  crypto.SHA256,
 			seed:  []byte("1.2.840.10045.3.1.7 point generation seed"),
+			kdf:   kdf,
 		}
 		switch h2cMethod(curveParams.Method) {
 		case H2C_SWU:
@@ -49,6 +69,32 @@ func (curveParams *CurveParams) GetH2CObj() (H2CObject, error) {
 		case H2C_INC:
 			return &P256SHA256Increment{params}, nil
 		}
+	case "p384":
+		params := &h2c{
+			curve: elliptic.P384(),
+			hash:  crypto.SHA384,
+			seed:  []byte("1.3.132.0.34 point generation seed"),
+			kdf:   kdf,
+		}
+		switch h2cMethod(curveParams.Method) {
+		case H2C_SWU:
+			return &P384SHA384SWU{params}, nil
+		case H2C_INC:
+			return &P384SHA384Increment{params}, nil
+		}
+	case "p521":
+		params := &h2c{
+			curve: elliptic.P521(),
+			hash:  crypto.SHA512,
+			seed:  []byte("1.3.132.0.35 point generation seed"),
+			kdf:   kdf,
+		}
+		switch h2cMethod(curveParams.Method) {
+		case H2C_SWU:
+			return &P521SHA512SWU{params}, nil
+		case H2C_INC:
+			return &P521SHA512Increment{params}, nil
+		}
 	}
 	return nil, fmt.Errorf("%s, curve: %v, hash: %v, method: %s",
 		ErrIncompatibleCurveParams.Error(),
@@ -59,10 +105,23 @@ type h2c struct {
 	curve elliptic.Curve
 	hash  crypto.Hash
 	seed  []byte
+	kdf   keyDerivation
 }
 
 func (obj *h2c) Curve() elliptic.Curve { return obj.curve }
 func (obj *h2c) Hash() crypto.Hash     { return obj.hash }
+func (obj *h2c) KeyDerivation() string { return string(obj.kdf) }
+
+// checkParams returns an error if obj was not set up with the curve and hash
+// that the named encoding expects.
+func (obj *h2c) checkParams(curve elliptic.Curve, hash crypto.Hash, name, method string) error {
+	if obj.curve != curve || obj.hash != hash {
+		return fmt.Errorf("%s for %s, curve: %v, hash: %v, method %s",
+			ErrIncompatibleCurveParams.Error(), name, obj.curve,
+			obj.hash, method)
+	}
+	return nil
+}
 
 // P256SHA256SWU calculates the Simplified SWU encoding by Brier et al.
 // given in "Efficient Indifferentiable Hashing into Ordinary Elliptic Curves".
@@ -73,11 +132,40 @@ type P256SHA256SWU struct{ *h2c }
 func (obj *P256SHA256SWU) Method() string { return string(H2C_SWU) }
 
 func (obj *P256SHA256SWU) HashToCurve(data []byte) (*Point, error) {
-	if obj.curve != elliptic.P256() || obj.hash != crypto.SHA256 {
-		return nil, fmt.Errorf("%s for P256SHA256SWU, curve: %v, hash: %v, method %s",
-			ErrIncompatibleCurveParams.Error(), obj.curve,
-			obj.hash, obj.Method())
+	err := obj.checkParams(elliptic.P256(), crypto.SHA256, "P256SHA256SWU", obj.Method())
+	if err != nil {
+		return nil, err
+	}
+	return obj.swu(data)
+}
+
+// P384SHA384SWU is the Simplified SWU encoding for P-384 with SHA-384.
+type P384SHA384SWU struct{ *h2c }
+
+func (obj *P384SHA384SWU) Method() string { return string(H2C_SWU) }
+
+func (obj *P384SHA384SWU) HashToCurve(data []byte) (*Point, error) {
+	err := obj.checkParams(elliptic.P384(), crypto.SHA384, "P384SHA384SWU", obj.Method())
+	if err != nil {
+		return nil, err
 	}
+	return obj.swu(data)
+}
+
+// P521SHA512SWU is the Simplified SWU encoding for P-521 with SHA-512.
+type P521SHA512SWU struct{ *h2c }
+
+func (obj *P521SHA512SWU) Method() string { return string(H2C_SWU) }
+
+func (obj *P521SHA512SWU) HashToCurve(data []byte) (*Point, error) {
+	err := obj.checkParams(elliptic.P521(), crypto.SHA512, "P521SHA512SWU", obj.Method())
+	if err != nil {
+		return nil, err
+	}
+	return obj.swu(data)
+}
+
+func (obj *h2c) swu(data []byte) (*Point, error) {
 	// Compute hash-to-curve based on the contents of the "method" field
 	t, err := obj.hashToBaseField(data)
 	if err != nil {
@@ -91,8 +179,9 @@ func (obj *P256SHA256SWU) HashToCurve(data []byte) (*Point, error) {
 	return P, nil
 }
 
-// Hashes bytes to a big.Int that will be interpreted as a field element
-func (obj *P256SHA256SWU) hashToBaseField(data []byte) (*big.Int, error) {
+// Hashes bytes to a big.Int that will be interpreted as a field element. For
+// P-521 the hash is shorter than the field, so the whole digest is used.
+func (obj *h2c) hashToBaseField(data []byte) (*big.Int, error) {
 	byteLen := getFieldByteLength(obj.curve)
 	h := obj.hash.New()
 	_, err := h.Write(obj.seed)
@@ -104,12 +193,15 @@ func (obj *P256SHA256SWU) hashToBaseField(data []byte) (*big.Int, error) {
 		return nil, err
 	}
 	sum := h.Sum(nil)
-	t := new(big.Int).SetBytes(sum[:byteLen])
+	if len(sum) > byteLen {
+		sum = sum[:byteLen]
+	}
+	t := new(big.Int).SetBytes(sum)
 	t.Mod(t, obj.curve.Params().P)
 	return t, nil
 }
 
-func (obj *P256SHA256SWU) simplifiedSWU(t *big.Int) (*Point, error) {
+func (obj *h2c) simplifiedSWU(t *big.Int) (*Point, error) {
 	var u, t0, y2, bDivA, g, pPlus1Div4, x, y big.Int
 	e := obj.curve.Params()
 	p := e.P
@@ -180,12 +272,43 @@ type P256SHA256Increment struct{ *h2c }
 func (obj *P256SHA256Increment) Method() string { return string(H2C_INC) }
 
 func (obj *P256SHA256Increment) HashToCurve(data []byte) (*Point, error) {
-	if obj.curve != elliptic.P256() || obj.hash != crypto.SHA256 {
-		return nil, fmt.Errorf("%s for P256SHA256Increment, curve: %v, hash: %v, method %s",
-			ErrIncompatibleCurveParams.Error(), obj.curve, obj.hash,
-			obj.Method())
+	err := obj.checkParams(elliptic.P256(), crypto.SHA256, "P256SHA256Increment", obj.Method())
+	if err != nil {
+		return nil, err
 	}
+	return obj.hashAndIncrement(data)
+}
+
+// P384SHA384Increment is the hash-and-increment encoding for P-384 with
+// SHA-384.
+type P384SHA384Increment struct{ *h2c }
+
+func (obj *P384SHA384Increment) Method() string { return string(H2C_INC) }
 
+func (obj *P384SHA384Increment) HashToCurve(data []byte) (*Point, error) {
+	err := obj.checkParams(elliptic.P384(), crypto.SHA384, "P384SHA384Increment", obj.Method())
+	if err != nil {
+		return nil, err
+	}
+	return obj.hashAndIncrement(data)
+}
+
+// P521SHA512Increment is the hash-and-increment encoding for P-521 with
+// SHA-512. The 64-byte digest is shorter than the 66-byte field, so candidate
+// x-coordinates are left-padded with zeroes.
+type P521SHA512Increment struct{ *h2c }
+
+func (obj *P521SHA512Increment) Method() string { return string(H2C_INC) }
+
+func (obj *P521SHA512Increment) HashToCurve(data []byte) (*Point, error) {
+	err := obj.checkParams(elliptic.P521(), crypto.SHA512, "P521SHA512Increment", obj.Method())
+	if err != nil {
+		return nil, err
+	}
+	return obj.hashAndIncrement(data)
+}
+
+func (obj *h2c) hashAndIncrement(data []byte) (*Point, error) {
 	// Compute hash-to-curve based on the contents of the "method" field
 	P := &Point{Curve: obj.curve, X: nil, Y: nil}
 	byteLen := getFieldByteLength(obj.curve)
@@ -210,7 +333,11 @@ func (obj *P256SHA256Increment) HashToCurve(data []byte) (*Point, error) {
 		}
 
 		sum := h.Sum(nil)
-		copy(buf[1:1+byteLen], sum[:byteLen])
+		n := len(sum)
+		if n > byteLen {
+			n = byteLen
+		}
+		copy(buf[1+byteLen-n:], sum[:n])
 
 		buf[0] = 0x02
 		err := P.Unmarshal(obj.curve, buf)
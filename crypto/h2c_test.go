@@ -10,21 +10,33 @@ import (
 
 // Test that the correct H2C object is returned for all supported curves
 func TestGetH2CObjSWU(t *testing.T) {
-	checkH2CObject(t, "p256", "sha256", "swu")
+	checkH2CObject(t, "p256", "sha256", "swu", elliptic.P256(), stdcrypto.SHA256)
 }
 func TestGetH2CObjInc(t *testing.T) {
-	checkH2CObject(t, "p256", "sha256", "increment")
+	checkH2CObject(t, "p256", "sha256", "increment", elliptic.P256(), stdcrypto.SHA256)
 }
-func checkH2CObject(t *testing.T, curve, hash, method string) {
+func TestGetH2CObjP384SWU(t *testing.T) {
+	checkH2CObject(t, "p384", "sha384", "swu", elliptic.P384(), stdcrypto.SHA384)
+}
+func TestGetH2CObjP384Inc(t *testing.T) {
+	checkH2CObject(t, "p384", "sha384", "increment", elliptic.P384(), stdcrypto.SHA384)
+}
+func TestGetH2CObjP521SWU(t *testing.T) {
+	checkH2CObject(t, "p521", "sha512", "swu", elliptic.P521(), stdcrypto.SHA512)
+}
+func TestGetH2CObjP521Inc(t *testing.T) {
+	checkH2CObject(t, "p521", "sha512", "increment", elliptic.P521(), stdcrypto.SHA512)
+}
+func checkH2CObject(t *testing.T, curve, hash, method string, expCurve elliptic.Curve, expHash stdcrypto.Hash) {
 	cp := &CurveParams{Curve: curve, Hash: hash, Method: method}
 	obj, err := cp.GetH2CObj()
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if obj.Curve() != elliptic.P256() {
+	if obj.Curve() != expCurve {
 		t.Fatal("Curve is incorrect: ", obj.Curve())
-	} else if obj.Hash() != stdcrypto.SHA256 {
+	} else if obj.Hash() != expHash {
 		t.Fatal("Hash is incorrect: ", obj.Hash())
 	} else if obj.Method() != method {
 		t.Fatal("Method is incorrect: ", obj.Method())
@@ -34,6 +46,26 @@ func checkH2CObject(t *testing.T, curve, hash, method string) {
 // Test that the different H2C methods generate valid points on the curve
 func TestHashAndIncrementCorrectness(t *testing.T) { HandleTest(t, "increment", hashToCurveCorrectness) }
 func TestSWUCorrectness(t *testing.T)              { HandleTest(t, "swu", hashToCurveCorrectness) }
+func TestP384IncrementCorrectness(t *testing.T) {
+	handleCurveTest(t, "p384", "sha384", "increment", hashToCurveCorrectness)
+}
+func TestP384SWUCorrectness(t *testing.T) {
+	handleCurveTest(t, "p384", "sha384", "swu", hashToCurveCorrectness)
+}
+func TestP521IncrementCorrectness(t *testing.T) {
+	handleCurveTest(t, "p521", "sha512", "increment", hashToCurveCorrectness)
+}
+func TestP521SWUCorrectness(t *testing.T) {
+	handleCurveTest(t, "p521", "sha512", "swu", hashToCurveCorrectness)
+}
+func handleCurveTest(t *testing.T, curve, hash, method string, testToRun func(t *testing.T, obj H2CObject)) {
+	curveParams := &CurveParams{Curve: curve, Hash: hash, Method: method}
+	h2cObj, err := curveParams.GetH2CObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testToRun(t, h2cObj)
+}
 func hashToCurveCorrectness(t *testing.T, h2cObj H2CObject) {
 	byteLen := getFieldByteLength(h2cObj.Curve())
 	data := make([]byte, byteLen)
@@ -47,7 +79,7 @@ func hashToCurveCorrectness(t *testing.T, h2cObj H2CObject) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !P.IsOnCurve() {
+	if P.Curve != h2cObj.Curve() || !P.IsOnCurve() {
 		t.Error("generated point P wasn't on the curve")
 	}
 
@@ -65,6 +97,17 @@ func hashToCurveCorrectness(t *testing.T, h2cObj H2CObject) {
 	}
 }
 
+// Test that an encoding refuses to run with another curve's parameters
+func TestIncompatibleCurveParams(t *testing.T) {
+	params := &h2c{curve: elliptic.P256(), hash: stdcrypto.SHA256}
+	for _, obj := range []H2CObject{&P384SHA384SWU{params}, &P384SHA384Increment{params}, &P521SHA512SWU{params}, &P521SHA512Increment{params}} {
+		_, err := obj.HashToCurve([]byte("data"))
+		if err == nil {
+			t.Errorf("%T hashed to curve with P-256 parameters", obj)
+		}
+	}
+}
+
 // Benchmarks for different H2C methods
 func BenchmarkHashAndIncrement(b *testing.B) {
 	curveParams := &CurveParams{Curve: "p256", Hash: "sha256", Method: "increment"}
@@ -0,0 +1,74 @@
+package crypto
+
+import (
+	"bytes"
+	stdcrypto "crypto"
+	"crypto/elliptic"
+	"encoding/hex"
+	"testing"
+)
+
+// Test cases 1-3 from RFC 5869 appendix A
+var hkdfTestVectors = []struct {
+	ikm, salt, info, okm string
+}{
+	{
+		ikm:  "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+		salt: "000102030405060708090a0b0c",
+		info: "f0f1f2f3f4f5f6f7f8f9",
+		okm:  "3cb25f25faacd57a90434f64d0362f2a2d2d0a90cf1a5a4c5db02d56ecc4c5bf34007208d5b887185865",
+	},
+	{
+		ikm: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f" +
+			"202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f" +
+			"404142434445464748494a4b4c4d4e4f",
+		salt: "606162636465666768696a6b6c6d6e6f707172737475767778797a7b7c7d7e7f" +
+			"808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f" +
+			"a0a1a2a3a4a5a6a7a8a9aaabacadaeaf",
+		info: "b0b1b2b3b4b5b6b7b8b9babbbcbdbebfc0c1c2c3c4c5c6c7c8c9cacbcccdcecf" +
+			"d0d1d2d3d4d5d6d7d8d9dadbdcdddedfe0e1e2e3e4e5e6e7e8e9eaebecedeeef" +
+			"f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff",
+		okm: "b11e398dc80327a1c8e7f78c596a49344f012eda2d4efad8a050cc4c19afa97c" +
+			"59045a99cac7827271cb41c65e590e09da3275600c2f09b8367793a9aca3db71" +
+			"cc30c58179ec3e87c14c01d5c1f3434f1d87",
+	},
+	{
+		ikm:  "0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b0b",
+		salt: "",
+		info: "",
+		okm:  "8da4e775a563c18f715f802a063c5a31b8a11f5c5ee1879ec3454e5f3c738d2d9d201395faa4b61a96c8",
+	},
+}
+
+// HKDF-Expand output is a prefix of any longer output, so the key is the
+// first 32 bytes of each vector's OKM
+func TestHKDFVectors(t *testing.T) {
+	for i, v := range hkdfTestVectors {
+		ikm, _ := hex.DecodeString(v.ikm)
+		salt, _ := hex.DecodeString(v.salt)
+		info, _ := hex.DecodeString(v.info)
+		okm, _ := hex.DecodeString(v.okm)
+
+		if got := hkdfKey(stdcrypto.SHA256, salt, ikm, info); !bytes.Equal(got, okm[:32]) {
+			t.Errorf("test case %d: key is %x, expected %x", i+1, got, okm[:32])
+		}
+	}
+}
+
+// Tests DeriveKeyHKDF against HKDF of the token and point it documents
+func TestDeriveKeyHKDF(t *testing.T) {
+	curve := elliptic.P256()
+	x, y := curve.ScalarBaseMult([]byte{7})
+	N := &Point{Curve: curve, X: x, Y: y}
+	token := []byte("token")
+
+	ikm := append(append([]byte{}, token...), N.Marshal()...)
+	expected := hkdfKey(stdcrypto.SHA256, []byte("hash_derive_key P-256"), ikm, []byte("hash_derive_key"))
+	key := DeriveKeyHKDF(stdcrypto.SHA256, N, token, []byte("hash_derive_key"))
+	if !bytes.Equal(key, expected) {
+		t.Fatalf("derived key is %x, expected %x", key, expected)
+	}
+	if hex.EncodeToString(key) != "025dd434b88fe2c6c0d471580e96046ee3db45ed78f93434d38ba7b659b4a76f" {
+		t.Errorf("derived key changed to %x", key)
+	}
+}
@@ -61,26 +61,28 @@ func ParseKeyFile(keyFilePath string, signingKey bool) ([]elliptic.Curve, [][]by
 	return curves, keys, nil
 }
 
-// Load the commitment to a generator that is currently in use as well.
-func ParseCommitmentFile(genFilePath string) ([]byte, []byte, error) {
+// Load the commitment to a generator that is currently in use as well. The
+// optional "version" field names the key version clients use to pick this
+// commitment, and is empty if the file doesn't have one.
+func ParseCommitmentFile(genFilePath string) ([]byte, []byte, string, error) {
 	commBytes, err := ioutil.ReadFile(genFilePath)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
 	var commJson map[string]string
 	if e := json.Unmarshal(commBytes, &commJson); e != nil {
-		return nil, nil, e
+		return nil, nil, "", e
 	}
 
 	GBytes, err := b64.StdEncoding.DecodeString(commJson["G"])
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 	HBytes, err := b64.StdEncoding.DecodeString(commJson["H"])
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, "", err
 	}
 
-	return GBytes, HBytes, nil
+	return GBytes, HBytes, commJson["version"], nil
 }
@@ -5,7 +5,10 @@ import (
 	"crypto"
 	"crypto/hmac"
 	crand "crypto/rand"
+	"io"
 	"math/big"
+
+	"golang.org/x/crypto/hkdf"
 )
 
 // BlindPoint generates a random blinding factor, scalar multiplies it to the
@@ -45,6 +48,32 @@ func DeriveKey(hash crypto.Hash, N *Point, token []byte) []byte {
 	return h.Sum(nil)
 }
 
+// DeriveKeyHKDF derives the shared key used for redemption MACs with HKDF
+// (RFC 5869). The input keying material is the token and the unblinded signed
+// point, the salt is fixed per curve and info binds the key to its use.
+func DeriveKeyHKDF(hash crypto.Hash, N *Point, token []byte, info []byte) []byte {
+	ikm := append(append([]byte{}, token...), N.Marshal()...)
+	salt := []byte("hash_derive_key " + N.Curve.Params().Name)
+	return hkdfKey(hash, salt, ikm, info)
+}
+
+// hkdfKey returns the first hash.Size() bytes of HKDF output
+func hkdfKey(hash crypto.Hash, salt, ikm, info []byte) []byte {
+	key := make([]byte, hash.Size())
+	// can't fail, at most 255 blocks of output may be read
+	io.ReadFull(hkdf.New(hash.New, ikm, salt, info), key)
+	return key
+}
+
+// DeriveSharedKey derives the redemption key with the key derivation function
+// selected in the curve parameters that h2cObj was created from.
+func DeriveSharedKey(h2cObj H2CObject, N *Point, token []byte) []byte {
+	if keyDerivation(h2cObj.KeyDerivation()) == KDF_HKDF {
+		return DeriveKeyHKDF(h2cObj.Hash(), N, token, []byte("hash_derive_key"))
+	}
+	return DeriveKey(h2cObj.Hash(), N, token)
+}
+
 func CreateRequestBinding(hash crypto.Hash, key []byte, data [][]byte) []byte {
 	h := hmac.New(hash.New, key)
 	h.Write([]byte("hash_request_binding"))
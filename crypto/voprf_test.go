@@ -92,3 +92,34 @@ func BenchmarkUnblindingP256(b *testing.B) {
 		UnblindPoint(P, r)
 	}
 }
+
+// Tests that the key derivation chosen in the curve parameters is the one used
+func TestDeriveSharedKey(t *testing.T) {
+	for _, kdf := range []string{"", "hmac", "hkdf"} {
+		curveParams := &CurveParams{Curve: "p256", Hash: "sha256", Method: "increment", KeyDerivation: kdf}
+		h2cObj, err := curveParams.GetH2CObj()
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, N, err := NewRandomPoint(h2cObj)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := DeriveKey(h2cObj.Hash(), N, token)
+		if kdf == "hkdf" {
+			expected = DeriveKeyHKDF(h2cObj.Hash(), N, token, []byte("hash_derive_key"))
+			if hmac.Equal(expected, DeriveKey(h2cObj.Hash(), N, token)) {
+				t.Fatal("HKDF and HMAC derived the same key")
+			}
+		}
+		if !hmac.Equal(DeriveSharedKey(h2cObj, N, token), expected) {
+			t.Errorf("key derivation %q used the wrong function", kdf)
+		}
+	}
+
+	curveParams := &CurveParams{Curve: "p256", Hash: "sha256", Method: "increment", KeyDerivation: "pbkdf2"}
+	if _, err := curveParams.GetH2CObj(); err == nil {
+		t.Fatal("unknown key derivation was accepted")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"math/big"
 	"net"
+	"sync"
 
 	"github.com/privacypass/challenge-bypass-server/crypto"
 	"github.com/privacypass/challenge-bypass-server/metrics"
@@ -20,10 +21,18 @@ var (
 	ErrTooFewRedemptionArguments = errors.New("REDEEM request did not contain enough arguments")
 	ErrUnexpectedRequestType     = errors.New("unexpected request type")
 	ErrInvalidBatchProof         = errors.New("New batch proof for signed tokens is invalid")
+	ErrInvalidPreimage           = errors.New("token preimage is malformed")
 	ErrNotOnCurve                = errors.New("One or more points not found on curve")
 
-	// XXX: this is a fairly expensive piece of init
-	SpentTokens = NewDoubleSpendList()
+	// XXX: this is a fairly expensive piece of init. The list is sized from
+	// the environment, see NewSpendListFromEnv, and the server refuses to
+	// start if SpentTokensErr is set.
+	SpentTokens, SpentTokensErr = NewSpendListFromEnv()
+
+	// The number of goroutines ApproveTokens signs a request with. Every
+	// request gets its own workers, so the default of 1 signs sequentially and
+	// leaves the other cores to concurrent requests.
+	SignWorkers = 1
 )
 
 // Recovers the curve parameters that are sent by the client
@@ -67,17 +76,8 @@ func ApproveTokens(req BlindTokenRequest, key []byte, keyVersion string, G, H *c
 		return issueResponse, err
 	}
 
-	// Sign the points
-	Q := make([]*crypto.Point, len(P))
-	for i := 0; i < len(Q); i++ {
-		if !P[i].IsOnCurve() {
-			return issueResponse, ErrNotOnCurve
-		}
-		Q[i] = crypto.SignPoint(P[i], key)
-	}
-
-	// Generate batch DLEQ proof
-	bp, err := crypto.NewBatchProof(h2cObj.Hash(), G, H, P, Q, new(big.Int).SetBytes(key))
+	// Sign the points and generate the batch DLEQ proof
+	Q, bp, err := SignWithConcurrency(h2cObj, P, key, G, H, SignWorkers)
 	if err != nil {
 		return issueResponse, err
 	}
@@ -109,6 +109,71 @@ func ApproveTokens(req BlindTokenRequest, key []byte, keyVersion string, G, H *c
 	return issueResponse, nil
 }
 
+// SignWithConcurrency signs the blinded points P with key using up to workers
+// goroutines, then creates a batch DLEQ proof over the signed points in the
+// same order as P with the same number of goroutines.
+func SignWithConcurrency(h2cObj crypto.H2CObject, P []*crypto.Point, key []byte, G, H *crypto.Point, workers int) ([]*crypto.Point, *crypto.BatchProof, error) {
+	for i := 0; i < len(P); i++ {
+		if !P[i].IsOnCurve() {
+			return nil, nil, ErrNotOnCurve
+		}
+	}
+	if workers > len(P) {
+		workers = len(P)
+	}
+
+	Q := make([]*crypto.Point, len(P))
+	if workers <= 1 {
+		for i := 0; i < len(Q); i++ {
+			Q[i] = crypto.SignPoint(P[i], key)
+		}
+	} else {
+		jobs := make(chan int, len(P))
+		for i := 0; i < len(P); i++ {
+			jobs <- i
+		}
+		close(jobs)
+
+		var wg sync.WaitGroup
+		wg.Add(workers)
+		for w := 0; w < workers; w++ {
+			go func() {
+				defer wg.Done()
+				for i := range jobs {
+					Q[i] = crypto.SignPoint(P[i], key)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+
+	bp, err := crypto.NewBatchProofParallel(h2cObj.Hash(), G, H, P, Q, new(big.Int).SetBytes(key), workers)
+	if err != nil {
+		return nil, nil, err
+	}
+	return Q, bp, nil
+}
+
+// ValidatePreimage rejects token preimages that could not have come from
+// crypto.CreateBlindToken before any curve operations are spent on them.
+// Preimages are random strings as long as the curve's field elements, so
+// constant strings of zero or 0xFF bytes are also refused.
+func ValidatePreimage(h2cObj crypto.H2CObject, token []byte) error {
+	byteLen := (h2cObj.Curve().Params().BitSize + 7) >> 3
+	if len(token) != byteLen {
+		return ErrInvalidPreimage
+	}
+	allZero, allOnes := true, true
+	for _, b := range token {
+		allZero = allZero && b == 0x00
+		allOnes = allOnes && b == 0xFF
+	}
+	if allZero || allOnes {
+		return ErrInvalidPreimage
+	}
+	return nil
+}
+
 // RedeemToken checks a redemption request against the observed request data
 // and MAC according a set of keys. keys keeps a set of private keys that
 // are ever used to sign the token so we can rotate private key easily
@@ -126,20 +191,26 @@ func RedeemToken(req BlindTokenRequest, host, path []byte, keys [][]byte) error
 		return err
 	}
 
+	err = ValidatePreimage(h2cObj, token)
+	if err != nil {
+		metrics.CounterRedeemErrorFormat.Inc()
+		return err
+	}
+
 	T, err := h2cObj.HashToCurve(token)
 	if err != nil {
 		return err
 	}
 	requestData := [][]byte{host, path}
 
+	// Check every key, even after a match, so the time taken doesn't reveal
+	// which key signed the token
 	var valid bool
 	for _, key := range keys {
 		sharedPoint := crypto.SignPoint(T, key)
-		sharedKey := crypto.DeriveKey(h2cObj.Hash(), sharedPoint, token)
-		valid = crypto.CheckRequestBinding(h2cObj.Hash(), sharedKey, requestBinder, requestData)
-		if valid {
-			break
-		}
+		sharedKey := crypto.DeriveSharedKey(h2cObj, sharedPoint, token)
+		ok := crypto.CheckRequestBinding(h2cObj.Hash(), sharedKey, requestBinder, requestData)
+		valid = valid || ok
 	}
 
 	if !valid {
@@ -147,13 +218,19 @@ func RedeemToken(req BlindTokenRequest, host, path []byte, keys [][]byte) error
 		return fmt.Errorf("%s, host: %s, path: %s, token: %v, request_binder: %v", ErrInvalidMAC.Error(), host, path, new(big.Int).SetBytes(token), new(big.Int).SetBytes(requestBinder))
 	}
 
+	if SpentTokens == nil {
+		SpentTokens = newSpendList()
+	}
 	doubleSpent := SpentTokens.CheckToken(token)
 	if doubleSpent {
 		metrics.CounterDoubleSpend.Inc()
 		return ErrDoubleSpend
 	}
 
-	SpentTokens.AddToken(token)
+	err = SpentTokens.AddToken(token)
+	if err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -182,6 +259,13 @@ func HandleIssue(conn *net.TCPConn, req BlindTokenRequest, key []byte, keyVersio
 		return err
 	}
 
+	// Record the signed tokens before they leave the server
+	entry := NewSigningAuditEntry(conn.RemoteAddr().String(), keyVersion, issueResponse.Sigs)
+	err = SigningAudit.Log(entry)
+	if err != nil {
+		return err
+	}
+
 	// Encodes the issue response as a JSON object
 	jsonResp, err := json.Marshal(issueResponse)
 	if err != nil {
@@ -194,7 +278,10 @@ func HandleIssue(conn *net.TCPConn, req BlindTokenRequest, key []byte, keyVersio
 
 	// write back as "[b64 blob]" since the extension expects them formatted as
 	// "signatures=[b64 blob]" in the HTTP response body
-	conn.Write(base64Envelope)
+	err = writeResponse(conn, base64Envelope)
+	if err != nil {
+		return err
+	}
 	metrics.CounterIssueSuccess.Inc()
 	return nil
 }
@@ -217,10 +304,6 @@ func HandleRedeem(conn *net.TCPConn, req BlindTokenRequest, host, path string, k
 		return ErrTooFewRedemptionArguments
 	}
 
-	if SpentTokens == nil {
-		SpentTokens = NewDoubleSpendList()
-	}
-
 	// transform request data here if necessary
 
 	err := RedeemToken(req, []byte(host), []byte(path), keys)
@@ -228,7 +311,20 @@ func HandleRedeem(conn *net.TCPConn, req BlindTokenRequest, host, path string, k
 		return err
 	}
 
-	conn.Write([]byte("success"))
+	err = writeResponse(conn, []byte("success"))
+	if err != nil {
+		return err
+	}
 	metrics.CounterRedeemSuccess.Inc()
 	return nil
 }
+
+// writeResponse writes resp back to the client. A write that runs into the
+// connection's write deadline is counted as a deadline timeout.
+func writeResponse(conn *net.TCPConn, resp []byte) error {
+	_, err := conn.Write(resp)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		metrics.CounterDeadlineTimeout.Inc()
+	}
+	return err
+}
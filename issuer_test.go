@@ -7,6 +7,9 @@ import (
 	crand "crypto/rand"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math/big"
+	"strings"
 	"testing"
 
 	"github.com/privacypass/challenge-bypass-server/crypto"
@@ -19,7 +22,12 @@ var (
 
 // Generates a small but well-formed ISSUE request for testing.
 func makeTokenIssueRequest(h2cObj crypto.H2CObject) (*BlindTokenRequest, [][]byte, []*crypto.Point, [][]byte, error) {
-	tokens := make([][]byte, 10)
+	return makeTokenIssueRequestN(h2cObj, 10)
+}
+
+// Generates a well-formed ISSUE request containing n tokens.
+func makeTokenIssueRequestN(h2cObj crypto.H2CObject, n int) (*BlindTokenRequest, [][]byte, []*crypto.Point, [][]byte, error) {
+	tokens := make([][]byte, n)
 	bF := make([][]byte, len(tokens))
 	bP := make([]*crypto.Point, len(tokens))
 	for i := 0; i < len(tokens); i++ {
@@ -90,14 +98,14 @@ func makeTokenRedempRequest(x []byte, G, H *crypto.Point, h2cObj crypto.H2CObjec
 	// c. Unblind a point
 	xT := crypto.UnblindPoint(xbP[0], bF[0])
 	// d. Derive MAC key
-	sk := crypto.DeriveKey(h2cObj.Hash(), xT, tokens[0])
+	sk := crypto.DeriveSharedKey(h2cObj, xT, tokens[0])
 	// e. MAC the request binding data
 	reqData := [][]byte{testHost, testPath}
 	reqBinder := crypto.CreateRequestBinding(h2cObj.Hash(), sk, reqData)
 	contents := [][]byte{tokens[0], reqBinder}
 	var h2cParamsBytes []byte
-	if h2cObj.Method() == "swu" {
-		curveParams := &crypto.CurveParams{Curve: "p256", Hash: "sha256", Method: "swu"}
+	if h2cObj.Method() == "swu" || h2cObj.KeyDerivation() == "hkdf" {
+		curveParams := &crypto.CurveParams{Curve: "p256", Hash: "sha256", Method: h2cObj.Method(), KeyDerivation: h2cObj.KeyDerivation()}
 		h2cParamsBytes, err = json.Marshal(curveParams)
 		if err != nil {
 			return nil, err
@@ -325,6 +333,16 @@ func tokenRedemption(t *testing.T, h2cObj crypto.H2CObject) {
 	}
 }
 
+// Tests redemption when the client asks for HKDF key derivation
+func TestTokenRedemptionHKDF(t *testing.T) {
+	curveParams := &crypto.CurveParams{Curve: "p256", Hash: "sha256", Method: "increment", KeyDerivation: "hkdf"}
+	h2cObj, err := curveParams.GetH2CObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenRedemption(t, h2cObj)
+}
+
 // Tests that MAC fails for bad values for each curve setting
 func TestBadMACIncrement(t *testing.T) { crypto.HandleTest(t, "increment", badMAC) }
 func TestBadMACSWU(t *testing.T)       { crypto.HandleTest(t, "swu", badMAC) }
@@ -346,3 +364,371 @@ func badMAC(t *testing.T, h2cObj crypto.H2CObject) {
 		t.Fatal("No error occurred even though MAC should be bad")
 	}
 }
+
+// Tests that tokens signed by a key that has since been dropped from the
+// redemption keys are rejected
+func TestExpiredKeyTokenRedemptionIncrement(t *testing.T) {
+	crypto.HandleTest(t, "increment", expiredKeyTokenRedemption)
+}
+func TestExpiredKeyTokenRedemptionSWU(t *testing.T) {
+	crypto.HandleTest(t, "swu", expiredKeyTokenRedemption)
+}
+func expiredKeyTokenRedemption(t *testing.T, h2cObj crypto.H2CObject) {
+	expired, G, H, err := fakeKeyAndCommitments(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _, _, err := fakeKeyAndCommitments(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blRedempreq, err := makeTokenRedempRequest(expired, G, H, h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RedeemToken(*blRedempreq, testHost, testPath, [][]byte{current})
+	if err == nil {
+		t.Fatal("redeemed a token signed by an expired key")
+	}
+	if !strings.HasPrefix(err.Error(), ErrInvalidMAC.Error()) {
+		t.Fatalf("unexpected error for expired key: %v", err)
+	}
+}
+
+// Tests that redeeming without any keys fails cleanly
+func TestTokenRedemptionWithEmptyKeysIncrement(t *testing.T) {
+	crypto.HandleTest(t, "increment", tokenRedemptionWithEmptyKeys)
+}
+func tokenRedemptionWithEmptyKeys(t *testing.T, h2cObj crypto.H2CObject) {
+	x, G, H, err := fakeKeyAndCommitments(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blRedempreq, err := makeTokenRedempRequest(x, G, H, h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, keys := range [][][]byte{nil, {}} {
+		err = RedeemToken(*blRedempreq, testHost, testPath, keys)
+		if err == nil {
+			t.Fatal("redeemed a token without any keys")
+		}
+	}
+}
+
+// Tests that issue requests over the limit are rejected before any signing
+func TestHandleIssueMaxTokensIncrement(t *testing.T) {
+	crypto.HandleTest(t, "increment", handleIssueMaxTokens)
+}
+func handleIssueMaxTokens(t *testing.T, h2cObj crypto.H2CObject) {
+	key, G, H, err := fakeKeyAndCommitments(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		tokens, maxTokens int
+	}{
+		{6, 5},
+		{2, 1},
+		{1, 0},
+	} {
+		req, _, _, _, err := makeTokenIssueRequestN(h2cObj, tc.tokens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the request must be refused before anything is written to conn
+		err = HandleIssue(nil, *req, key, "1.0", G, H, tc.maxTokens)
+		if err != ErrTooManyTokens {
+			t.Errorf("%d tokens with max %d: expected ErrTooManyTokens, got %v", tc.tokens, tc.maxTokens, err)
+		}
+	}
+}
+
+// Tests that signing with a worker pool keeps the signed points in order
+func TestSignWithConcurrencyIncrement(t *testing.T) {
+	crypto.HandleTest(t, "increment", signWithConcurrency)
+}
+func signWithConcurrency(t *testing.T, h2cObj crypto.H2CObject) {
+	key, G, H, err := fakeKeyAndCommitments(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, P, _, err := makeTokenIssueRequestN(h2cObj, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sequential, _, err := SignWithConcurrency(h2cObj, P, key, G, H, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{4, 8, 200} {
+		Q, bp, err := SignWithConcurrency(h2cObj, P, key, G, H, workers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bp.Z) != len(Q) {
+			t.Fatalf("proof covers %d points, expected %d", len(bp.Z), len(Q))
+		}
+		for i := range Q {
+			if Q[i].X.Cmp(sequential[i].X) != 0 || Q[i].Y.Cmp(sequential[i].Y) != 0 {
+				t.Fatalf("%d workers: signed point %d differs from sequential signing", workers, i)
+			}
+			if bp.Z[i] != Q[i] {
+				t.Fatalf("%d workers: proof point %d is out of order", workers, i)
+			}
+		}
+		if !bp.Verify() {
+			t.Fatalf("%d workers: batch proof is invalid", workers)
+		}
+	}
+
+	// an off-curve point must be rejected before any signing
+	P[50] = &crypto.Point{Curve: h2cObj.Curve(), X: big.NewInt(1), Y: big.NewInt(1)}
+	if _, _, err = SignWithConcurrency(h2cObj, P, key, G, H, 4); err != ErrNotOnCurve {
+		t.Fatalf("expected ErrNotOnCurve, got %v", err)
+	}
+}
+
+// Tests that a token is accepted wherever its signing key sits in the list of
+// redemption keys, including the last one that is checked
+func TestRedeemTokenChecksAllKeysIncrement(t *testing.T) {
+	crypto.HandleTest(t, "increment", redeemTokenChecksAllKeys)
+}
+func redeemTokenChecksAllKeys(t *testing.T, h2cObj crypto.H2CObject) {
+	for _, signerIndex := range []int{0, 4} {
+		keys, req, err := redeemKeysAndRequest(h2cObj, 5, signerIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = RedeemToken(*req, testHost, testPath, keys); err != nil {
+			t.Fatalf("token signed with key %d was rejected: %v", signerIndex, err)
+		}
+	}
+}
+
+func redeemKeysAndRequest(h2cObj crypto.H2CObject, n, signerIndex int) ([][]byte, *BlindTokenRequest, error) {
+	keys := make([][]byte, n)
+	var req *BlindTokenRequest
+	for i := 0; i < n; i++ {
+		key, G, H, err := fakeKeyAndCommitments(h2cObj)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys[i] = key
+		if i == signerIndex {
+			req, err = makeTokenRedempRequest(key, G, H, h2cObj)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return keys, req, nil
+}
+
+func TestValidatePreimageIncrement(t *testing.T) { crypto.HandleTest(t, "increment", validatePreimage) }
+func validatePreimage(t *testing.T, h2cObj crypto.H2CObject) {
+	token, _, _, err := crypto.CreateBlindToken(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ValidatePreimage(h2cObj, token); err != nil {
+		t.Fatalf("valid preimage was rejected: %v", err)
+	}
+
+	for name, preimage := range map[string][]byte{
+		"empty":     {},
+		"too short": token[1:],
+		"too long":  append(append([]byte{}, token...), 0x01),
+		"all zero":  make([]byte, len(token)),
+		"all 0xFF":  bytes.Repeat([]byte{0xFF}, len(token)),
+	} {
+		if err = ValidatePreimage(h2cObj, preimage); err != ErrInvalidPreimage {
+			t.Errorf("%s preimage: expected ErrInvalidPreimage, got %v", name, err)
+		}
+	}
+
+	// RedeemToken refuses the preimage before checking any keys
+	req := BlindTokenRequest{Type: REDEEM, Contents: [][]byte{make([]byte, len(token)), []byte("binding")}}
+	if err = RedeemToken(req, testHost, testPath, nil); err != ErrInvalidPreimage {
+		t.Fatalf("expected ErrInvalidPreimage from RedeemToken, got %v", err)
+	}
+}
+
+func benchmarkH2CObj(b *testing.B) crypto.H2CObject {
+	curveParams := &crypto.CurveParams{Curve: "p256", Hash: "sha256", Method: "increment"}
+	h2cObj, err := curveParams.GetH2CObj()
+	if err != nil {
+		b.Fatal(err)
+	}
+	return h2cObj
+}
+
+// Benchmarks for the individual operations performed on each token
+func BenchmarkSignToken(b *testing.B) {
+	h2cObj := benchmarkH2CObj(b)
+	key, err := fakeSigningKey(h2cObj)
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, P, err := crypto.NewRandomPoint(h2cObj)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			crypto.SignPoint(P, key)
+		}
+	})
+}
+
+func BenchmarkDeriveVerificationKey(b *testing.B) {
+	h2cObj := benchmarkH2CObj(b)
+	token, P, err := crypto.NewRandomPoint(h2cObj)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			crypto.DeriveSharedKey(h2cObj, P, token)
+		}
+	})
+}
+
+func BenchmarkVerifySignature(b *testing.B) {
+	h2cObj := benchmarkH2CObj(b)
+	token, P, err := crypto.NewRandomPoint(h2cObj)
+	if err != nil {
+		b.Fatal(err)
+	}
+	sk := crypto.DeriveKey(h2cObj.Hash(), P, token)
+	reqData := [][]byte{testHost, testPath}
+	reqBinder := crypto.CreateRequestBinding(h2cObj.Hash(), sk, reqData)
+
+	b.ReportAllocs()
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if !crypto.CheckRequestBinding(h2cObj.Hash(), sk, reqBinder, reqData) {
+				b.Error("request binding did not verify")
+				return
+			}
+		}
+	})
+}
+
+// Recomputes the unblinded signed point from a token preimage, as done for
+// each key during redemption
+func BenchmarkRederiveUnblindedToken(b *testing.B) {
+	h2cObj := benchmarkH2CObj(b)
+	key, err := fakeSigningKey(h2cObj)
+	if err != nil {
+		b.Fatal(err)
+	}
+	token, _, err := crypto.NewRandomPoint(h2cObj)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			T, err := h2cObj.HashToCurve(token)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			crypto.SignPoint(T, key)
+		}
+	})
+}
+
+func BenchmarkRandomSigningKey(b *testing.B) {
+	h2cObj := benchmarkH2CObj(b)
+
+	b.ReportAllocs()
+	b.SetParallelism(4)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := fakeSigningKey(h2cObj); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// Benchmarks ApproveTokens across batch sizes
+func BenchmarkApproveTokens_1(b *testing.B)   { benchmarkApproveTokens(b, 1) }
+func BenchmarkApproveTokens_10(b *testing.B)  { benchmarkApproveTokens(b, 10) }
+func BenchmarkApproveTokens_100(b *testing.B) { benchmarkApproveTokens(b, 100) }
+func benchmarkApproveTokens(b *testing.B, n int) {
+	h2cObj := benchmarkH2CObj(b)
+	key, G, H, err := fakeKeyAndCommitments(h2cObj)
+	if err != nil {
+		b.Fatal(err)
+	}
+	req, _, _, _, err := makeTokenIssueRequestN(h2cObj, n)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ApproveTokens(*req, key, "1.1", G, H); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Compares sequential signing of a full batch with worker pools
+func BenchmarkApproveTokensConcurrent(b *testing.B) {
+	h2cObj := benchmarkH2CObj(b)
+	key, G, H, err := fakeKeyAndCommitments(h2cObj)
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, _, P, _, err := makeTokenIssueRequestN(h2cObj, 100)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, workers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, _, err := SignWithConcurrency(h2cObj, P, key, G, H, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// Benchmarks redemption against one key and against five keys with the
+// signing key first or last. The token is spent after the first iteration,
+// which is only checked once every key has been tried.
+func BenchmarkRedeemToken_1Key(b *testing.B)       { benchmarkRedeemToken(b, 1, 0) }
+func BenchmarkRedeemToken_5KeysFirst(b *testing.B) { benchmarkRedeemToken(b, 5, 0) }
+func BenchmarkRedeemToken_5KeysLast(b *testing.B)  { benchmarkRedeemToken(b, 5, 4) }
+func benchmarkRedeemToken(b *testing.B, n, signerIndex int) {
+	keys, req, err := redeemKeysAndRequest(benchmarkH2CObj(b), n, signerIndex)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		RedeemToken(*req, testHost, testPath, keys)
+	}
+}
@@ -0,0 +1,321 @@
+// A load generator for the blind signing server. It issues batches of blinded
+// tokens at a fixed rate, unblinds the signatures it gets back and redeems the
+// resulting tokens at a second fixed rate, then reports latency percentiles
+// for both request types.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/privacypass/challenge-bypass-server"
+	"github.com/privacypass/challenge-bypass-server/crypto"
+)
+
+var (
+	ErrRedeemRejected = errors.New("server did not accept the redemption")
+
+	errLog *log.Logger = log.New(os.Stderr, "[loadtest] ", log.LstdFlags)
+
+	testHost = []byte("example.com")
+	testPath = []byte("/index.html")
+)
+
+type config struct {
+	ServerAddr  string
+	IssueRPS    int
+	RedeemRPS   int
+	Tokens      int
+	Concurrency int
+	Duration    time.Duration
+	OutFile     string
+	MaxP99      time.Duration
+	FailOnError bool
+}
+
+// A signed token that is ready to be redeemed
+type redeemable struct {
+	token []byte
+	N     *crypto.Point
+}
+
+type sample struct {
+	op      string
+	latency time.Duration
+	err     error
+}
+
+type runner struct {
+	cfg    config
+	h2cObj crypto.H2CObject
+	tokens chan redeemable
+
+	lock    sync.Mutex
+	samples []sample
+	dropped map[string]int
+}
+
+func (r *runner) record(op string, start time.Time, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.samples = append(r.samples, sample{op: op, latency: time.Since(start), err: err})
+}
+
+func (r *runner) drop(op string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.dropped[op]++
+}
+
+// roundTrip writes a single request and reads the response until the server
+// closes the connection.
+func (r *runner) roundTrip(request btd.BlindTokenRequest, host, path string) ([]byte, error) {
+	reqBytes, err := btd.MarshalRequest(request)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := btd.MarshalRequest(btd.BlindTokenRequestWrapper{
+		Request: reqBytes,
+		Host:    host,
+		Path:    path,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("tcp", r.cfg.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write(wrapped); err != nil {
+		return nil, err
+	}
+	// signal the end of the request so the server doesn't wait for its read deadline
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	}
+	return ioutil.ReadAll(conn)
+}
+
+func (r *runner) issue() error {
+	tokens := make([][]byte, r.cfg.Tokens)
+	blinds := make([][]byte, r.cfg.Tokens)
+	points := make([]*crypto.Point, r.cfg.Tokens)
+	for i := 0; i < r.cfg.Tokens; i++ {
+		token, P, blind, err := crypto.CreateBlindToken(r.h2cObj)
+		if err != nil {
+			return err
+		}
+		tokens[i], points[i], blinds[i] = token, P, blind
+	}
+	contents, err := crypto.BatchMarshalPoints(points)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	resp, err := r.roundTrip(btd.BlindTokenRequest{Type: btd.ISSUE, Contents: contents}, "", "")
+	if err == nil {
+		err = r.collectSignatures(resp, tokens, blinds)
+	}
+	r.record("issue", start, err)
+	return err
+}
+
+// collectSignatures unblinds the issued tokens and queues them for redemption
+func (r *runner) collectSignatures(resp []byte, tokens, blinds [][]byte) error {
+	jsonResp, err := base64.StdEncoding.DecodeString(string(resp))
+	if err != nil {
+		return err
+	}
+	var issued btd.IssuedTokenResponse
+	if err = json.Unmarshal(jsonResp, &issued); err != nil {
+		return err
+	}
+	signed, err := crypto.BatchUnmarshalPoints(r.h2cObj.Curve(), issued.Sigs)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(signed) && i < len(tokens); i++ {
+		select {
+		case r.tokens <- redeemable{token: tokens[i], N: crypto.UnblindPoint(signed[i], blinds[i])}:
+		default:
+			// enough tokens are already waiting to be redeemed
+			return nil
+		}
+	}
+	return nil
+}
+
+func (r *runner) redeem() error {
+	var t redeemable
+	select {
+	case t = <-r.tokens:
+	default:
+		r.drop("redeem")
+		return nil
+	}
+
+	key := crypto.DeriveSharedKey(r.h2cObj, t.N, t.token)
+	binding := crypto.CreateRequestBinding(r.h2cObj.Hash(), key, [][]byte{testHost, testPath})
+
+	start := time.Now()
+	resp, err := r.roundTrip(btd.BlindTokenRequest{Type: btd.REDEEM, Contents: [][]byte{t.token, binding}}, string(testHost), string(testPath))
+	if err == nil && string(resp) != "success" {
+		err = fmt.Errorf("%s: %q", ErrRedeemRejected.Error(), resp)
+	}
+	r.record("redeem", start, err)
+	return err
+}
+
+// schedule calls fn rps times per second until the deadline, using at most
+// cfg.Concurrency goroutines. Ticks that find every worker busy are dropped.
+func (r *runner) schedule(op string, rps int, deadline time.Time, fn func() error, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if rps <= 0 {
+		return
+	}
+
+	slots := make(chan struct{}, r.cfg.Concurrency)
+	var inflight sync.WaitGroup
+	ticker := time.NewTicker(time.Second / time.Duration(rps))
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if now.After(deadline) {
+			break
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			r.drop(op)
+			continue
+		}
+		inflight.Add(1)
+		go func() {
+			defer inflight.Done()
+			defer func() { <-slots }()
+			if err := fn(); err != nil {
+				errLog.Printf("%s: %v", op, err)
+			}
+		}()
+	}
+	inflight.Wait()
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+// report prints latency percentiles per request type and writes every sample
+// to w as CSV for plotting. It returns the p99 latency of each request type.
+func (r *runner) report(w io.Writer) (p99 map[string]time.Duration, errCount map[string]int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	fmt.Fprintln(w, "op,latency_ms,error")
+	byOp := map[string][]time.Duration{}
+	errCount = map[string]int{}
+	for _, s := range r.samples {
+		errStr := ""
+		if s.err != nil {
+			errStr = s.err.Error()
+			errCount[s.op]++
+		} else {
+			byOp[s.op] = append(byOp[s.op], s.latency)
+		}
+		fmt.Fprintf(w, "%s,%.3f,%q\n", s.op, float64(s.latency)/float64(time.Millisecond), errStr)
+	}
+
+	p99 = map[string]time.Duration{}
+	for _, op := range []string{"issue", "redeem"} {
+		latencies := byOp[op]
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		p99[op] = percentile(latencies, 0.99)
+		fmt.Printf("%-7s ok: %d errors: %d dropped: %d p50: %v p95: %v p99: %v\n",
+			op, len(latencies), errCount[op], r.dropped[op],
+			percentile(latencies, 0.50), percentile(latencies, 0.95), p99[op])
+	}
+	return p99, errCount
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.ServerAddr, "server-addr", "127.0.0.1:2416", "host:port of the server under test")
+	flag.IntVar(&cfg.IssueRPS, "rps", 10, "issue requests per second")
+	flag.IntVar(&cfg.RedeemRPS, "redeem-rps", 50, "redeem requests per second")
+	flag.IntVar(&cfg.Tokens, "tokens", 100, "number of tokens per issue request")
+	flag.IntVar(&cfg.Concurrency, "concurrency", 16, "maximum in-flight requests per request type")
+	flag.DurationVar(&cfg.Duration, "duration", 30*time.Second, "how long to generate load for")
+	flag.StringVar(&cfg.OutFile, "out", "loadtest.csv", "output path for per-request latencies")
+	flag.DurationVar(&cfg.MaxP99, "max-p99", 0, "exit with an error if the p99 latency of either request type is above this (0 disables the check)")
+	flag.BoolVar(&cfg.FailOnError, "fail-on-error", false, "exit with an error if any request failed")
+	flag.Parse()
+
+	if cfg.Concurrency <= 0 || cfg.Tokens <= 0 {
+		flag.Usage()
+		return
+	}
+
+	// The server only signs P256-SHA256-increment tokens
+	curveParams := &crypto.CurveParams{Curve: "p256", Hash: "sha256", Method: "increment"}
+	h2cObj, err := curveParams.GetH2CObj()
+	if err != nil {
+		errLog.Fatal(err)
+	}
+
+	r := &runner{
+		cfg:     cfg,
+		h2cObj:  h2cObj,
+		tokens:  make(chan redeemable, 100*cfg.Tokens),
+		dropped: map[string]int{},
+	}
+
+	deadline := time.Now().Add(cfg.Duration)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go r.schedule("issue", cfg.IssueRPS, deadline, r.issue, &wg)
+	go r.schedule("redeem", cfg.RedeemRPS, deadline, r.redeem, &wg)
+	wg.Wait()
+
+	out, err := os.Create(cfg.OutFile)
+	if err != nil {
+		errLog.Fatal(err)
+	}
+	p99, errCount := r.report(out)
+	if err = out.Close(); err != nil {
+		errLog.Fatal(err)
+	}
+
+	failed := false
+	for _, op := range []string{"issue", "redeem"} {
+		if cfg.MaxP99 > 0 && p99[op] > cfg.MaxP99 {
+			errLog.Printf("%s p99 latency %v is above the limit of %v", op, p99[op], cfg.MaxP99)
+			failed = true
+		}
+		if cfg.FailOnError && errCount[op] > 0 {
+			errLog.Printf("%d %s requests failed", errCount[op], op)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -24,6 +24,10 @@ var (
 		Name: "conn_errors",
 		Help: "Number of failed connection attempts",
 	})
+	CounterDeadlineTimeout = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "deadline_timeout_total",
+		Help: "Number of connections that hit the read or write deadline",
+	})
 	CounterRedeemTotal = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "total_redeem",
 		Help: "Total number of redemption requests",
@@ -72,6 +76,18 @@ var (
 		Name: "total_unk_req_type",
 		Help: "Total number of verification errors due to failure reading req type",
 	})
+	GaugeDoubleSpendFilterType = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "double_spend_filter_type",
+		Help: "Filter backing the double-spend list (0=bloom, 1=cuckoo)",
+	})
+	GaugeBloomFillRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "bloom_filter_fill_ratio",
+		Help: "Tokens added to the bloom double-spend list divided by its number of cells; above 1 the filter has started evicting old tokens",
+	})
+	GaugeCuckooFillRatio = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "cuckoo_filter_fill_ratio",
+		Help: "Tokens in the cuckoo double-spend list divided by its capacity; redemptions are rejected once it is full",
+	})
 	BuildInfo = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "build_info",
@@ -83,11 +99,12 @@ var (
 
 func RegisterAndListen(listenAddr string, errLog *log.Logger) {
 	collector := []prometheus.Collector{
-		CounterConnections, CounterConnErrors, CounterRedeemTotal,
-		CounterRedeemSuccess, CounterRedeemError, CounterRedeemErrorFormat,
-		CounterRedeemErrorVerify, CounterIssueTotal, CounterIssueSuccess,
-		CounterIssueError, CounterIssueErrorFormat, CounterJsonError,
-		CounterDoubleSpend, CounterUnknownRequestType, BuildInfo,
+		CounterConnections, CounterConnErrors, CounterDeadlineTimeout,
+		CounterRedeemTotal, CounterRedeemSuccess, CounterRedeemError,
+		CounterRedeemErrorFormat, CounterRedeemErrorVerify, CounterIssueTotal,
+		CounterIssueSuccess, CounterIssueError, CounterIssueErrorFormat,
+		CounterJsonError, CounterDoubleSpend, CounterUnknownRequestType,
+		GaugeDoubleSpendFilterType, GaugeBloomFillRatio, GaugeCuckooFillRatio, BuildInfo,
 	}
 
 	reg := prometheus.NewRegistry()
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/elliptic"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -11,6 +13,10 @@ import (
 	"log"
 	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/privacypass/challenge-bypass-server"
@@ -22,11 +28,16 @@ var (
 	Version         = "dev"
 	maxBackoffDelay = 1 * time.Second
 	maxRequestSize  = int64(20 * 1024) // ~10kB is expected size for 100*base64([64]byte) + ~framing
+	maxAuditLogSize = int64(100 * 1024 * 1024)
 
 	ErrEmptyKeyPath        = errors.New("key file path is empty")
+	ErrUnsupportedKeyCurve = errors.New("signing key is not a P-256 key")
 	ErrNoSecretKey         = errors.New("server config does not contain a key")
 	ErrRequestTooLarge     = errors.New("request too large to process")
 	ErrUnrecognizedRequest = errors.New("received unrecognized request type")
+	ErrShutdownTimeout     = errors.New("connections were still open at the end of the shutdown grace period")
+	ErrKeyVersionUnchanged = errors.New("the commitment changed but the key version did not")
+	ErrKeyVersionMissing   = errors.New("a reloaded commitment must set \"version\"")
 	// Commitments are embedded straight into the extension for now
 	ErrEmptyCommPath = errors.New("no commitment file path specified")
 
@@ -38,31 +49,60 @@ type Server struct {
 	ListenPort         int    `json:"listen_port,omitempty"`
 	MetricsPort        int    `json:"metrics_port,omitempty"`
 	MaxTokens          int    `json:"max_tokens,omitempty"`
+	SignWorkers        int    `json:"sign_workers,omitempty"`
+	ReadDeadlineMs     int    `json:"read_deadline_ms,omitempty"`
+	WriteDeadlineMs    int    `json:"write_deadline_ms,omitempty"`
+	ShutdownGraceMs    int    `json:"shutdown_grace_ms,omitempty"`
+	KeyReloadMs        int    `json:"key_reload_ms,omitempty"`
 	SignKeyFilePath    string `json:"key_file_path"`
 	RedeemKeysFilePath string `json:"redeem_keys_file_path"`
 	CommFilePath       string `json:"comm_file_path"`
+	SigningAuditPath   string `json:"signing_audit_log_path,omitempty"`
+	LogIncludeCaller   bool   `json:"log_include_caller"`
+
+	defaultKeyVersion string // the key version used when the commitment file doesn't name one
+
+	keyLock    sync.RWMutex    // guards the key material below, which is replaced when the key files change
+	signKey    []byte          // a big-endian marshaled big.Int representing an elliptic curve scalar for the current signing key
+	redeemKeys [][]byte        // current signing key + all old keys
+	G          *crypto.Point   // elliptic curve point representation of generator G
+	H          *crypto.Point   // elliptic curve point representation of commitment H to signing key
+	keyVersion string          // the version of the key that is used
+	keyFiles   [3]keyFileState // state of the key files that were loaded
+}
 
-	signKey    []byte        // a big-endian marshaled big.Int representing an elliptic curve scalar for the current signing key
-	redeemKeys [][]byte      // current signing key + all old keys
-	G          *crypto.Point // elliptic curve point representation of generator G
-	H          *crypto.Point // elliptic curve point representation of commitment H to signing key
-	keyVersion string        // the version of the key that is used
+// keyFileState is what WatchKeyFile compares to notice a changed key file.
+// The size is included because a rewrite within the mtime resolution of the
+// filesystem leaves the modification time as it was.
+type keyFileState struct {
+	modTime time.Time
+	size    int64
 }
 
-var DefaultServer = &Server{
-	BindAddress: "127.0.0.1",
-	ListenPort:  2416,
-	MetricsPort: 2417,
-	MaxTokens:   100,
+// newDefaultServer returns a Server with the default settings. A Server holds
+// a lock, so it must not be copied once created.
+func newDefaultServer() *Server {
+	return &Server{
+		BindAddress:      "127.0.0.1",
+		ListenPort:       2416,
+		MetricsPort:      2417,
+		MaxTokens:        100,
+		SignWorkers:      1,
+		ReadDeadlineMs:   100,
+		WriteDeadlineMs:  0,
+		ShutdownGraceMs:  30000,
+		KeyReloadMs:      10000,
+		LogIncludeCaller: true,
+	}
 }
 
-func loadConfigFile(filePath string) (Server, error) {
-	conf := *DefaultServer
+func loadConfigFile(filePath string) (*Server, error) {
+	conf := newDefaultServer()
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return conf, err
 	}
-	err = json.Unmarshal(data, &conf)
+	err = json.Unmarshal(data, conf)
 	if err != nil {
 		return conf, err
 	}
@@ -74,7 +114,9 @@ func (c *Server) handle(conn *net.TCPConn) error {
 	metrics.CounterConnections.Inc()
 
 	// This is directly in the user's path, an overly slow connection should just fail
-	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if c.ReadDeadlineMs > 0 {
+		conn.SetReadDeadline(time.Now().Add(time.Duration(c.ReadDeadlineMs) * time.Millisecond))
+	}
 
 	// Read the request but never more than a worst-case assumption
 	var buf = new(bytes.Buffer)
@@ -82,7 +124,11 @@ func (c *Server) handle(conn *net.TCPConn) error {
 	_, err := io.Copy(buf, limitedConn)
 
 	if err != nil {
-		if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "i/o timeout" && buf.Len() > 0 {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			metrics.CounterDeadlineTimeout.Inc()
+			if buf.Len() == 0 {
+				return err
+			}
 			// then probably we just hit the read deadline, so try to unwrap anyway
 		} else {
 			metrics.CounterConnErrors.Inc()
@@ -90,6 +136,12 @@ func (c *Server) handle(conn *net.TCPConn) error {
 		}
 	}
 
+	// The write deadline starts once the request has been read, so it also
+	// covers signing the tokens
+	if c.WriteDeadlineMs > 0 {
+		conn.SetWriteDeadline(time.Now().Add(time.Duration(c.WriteDeadlineMs) * time.Millisecond))
+	}
+
 	var wrapped btd.BlindTokenRequestWrapper
 	var request btd.BlindTokenRequest
 
@@ -104,10 +156,14 @@ func (c *Server) handle(conn *net.TCPConn) error {
 		return err
 	}
 
+	c.keyLock.RLock()
+	signKey, redeemKeys, G, H, keyVersion := c.signKey, c.redeemKeys, c.G, c.H, c.keyVersion
+	c.keyLock.RUnlock()
+
 	switch request.Type {
 	case btd.ISSUE:
 		metrics.CounterIssueTotal.Inc()
-		err = btd.HandleIssue(conn, request, c.signKey, c.keyVersion, c.G, c.H, c.MaxTokens)
+		err = btd.HandleIssue(conn, request, signKey, keyVersion, G, H, c.MaxTokens)
 		if err != nil {
 			metrics.CounterIssueError.Inc()
 			return err
@@ -115,7 +171,7 @@ func (c *Server) handle(conn *net.TCPConn) error {
 		return nil
 	case btd.REDEEM:
 		metrics.CounterRedeemTotal.Inc()
-		err = btd.HandleRedeem(conn, request, wrapped.Host, wrapped.Path, c.redeemKeys)
+		err = btd.HandleRedeem(conn, request, wrapped.Host, wrapped.Path, redeemKeys)
 		if err != nil {
 			metrics.CounterRedeemError.Inc()
 			conn.Write([]byte(err.Error())) // anything other than "success" counts as a VERIFY_ERROR
@@ -129,7 +185,14 @@ func (c *Server) handle(conn *net.TCPConn) error {
 	}
 }
 
-// loadKeys loads a signing key and optionally loads a file containing old keys for redemption validation
+// loadKeys loads a signing key, its commitment and optionally a file
+// containing old keys for redemption validation. A reload gives the same keys
+// as a restart with the same files, so a replaced signing key only stays
+// valid for redemptions if it is moved into the redeem keys file.
+//
+// Clients pick the commitment to verify proofs against by the key version, so
+// a reload that changes the commitment must also change the version given in
+// the commitment file.
 func (c *Server) loadKeys() error {
 	if c.SignKeyFilePath == "" {
 		return ErrEmptyKeyPath
@@ -137,13 +200,19 @@ func (c *Server) loadKeys() error {
 		return ErrEmptyCommPath
 	}
 
+	// Taken before reading so that a file written while loading is reloaded
+	fileStates := c.keyFileStates()
+
 	// Parse current signing key
-	_, currkey, err := crypto.ParseKeyFile(c.SignKeyFilePath, true)
+	curves, currkey, err := crypto.ParseKeyFile(c.SignKeyFilePath, true)
 	if err != nil {
 		return err
 	}
-	c.signKey = currkey[0]
-	c.redeemKeys = append(c.redeemKeys, c.signKey)
+	if curves[0] != elliptic.P256() {
+		return ErrUnsupportedKeyCurve
+	}
+	signKey := currkey[0]
+	redeemKeys := [][]byte{signKey}
 
 	// optionally parse old keys that are valid for redemption
 	if c.RedeemKeysFilePath != "" {
@@ -152,14 +221,106 @@ func (c *Server) loadKeys() error {
 		if err != nil {
 			return err
 		}
-		c.redeemKeys = append(c.redeemKeys, oldKeys...)
+		redeemKeys = append(redeemKeys, oldKeys...)
 	}
 
+	// Get bytes for public commitment to private key
+	GBytes, HBytes, keyVersion, err := crypto.ParseCommitmentFile(c.CommFilePath)
+	if err != nil {
+		return err
+	}
+	versioned := keyVersion != ""
+	if !versioned {
+		keyVersion = c.defaultKeyVersion
+	}
+
+	// Retrieve the actual elliptic curve points for the commitment
+	// The commitment should match the current key that is being used for
+	// signing
+	//
+	// Issuance only supports P256-SHA256 so far, so the commitment must be too.
+	// The P-384 and P-521 encodings in crypto can't be served until
+	// ApproveTokens takes the curve from the key.
+	G, H, err := crypto.RetrieveCommPoints(elliptic.P256(), GBytes, HBytes, signKey)
+	if err != nil {
+		return err
+	}
+
+	c.keyLock.Lock()
+	defer c.keyLock.Unlock()
+	if len(c.signKey) != 0 {
+		changed := !bytes.Equal(G.Marshal(), c.G.Marshal()) || !bytes.Equal(H.Marshal(), c.H.Marshal())
+		if changed && !versioned {
+			return ErrKeyVersionMissing
+		} else if changed && keyVersion == c.keyVersion {
+			return ErrKeyVersionUnchanged
+		}
+	} else if !versioned && c.KeyReloadMs > 0 {
+		errLog.Printf("WARNING: %s has no \"version\", so a new commitment is only loaded by a restart with a new --keyversion", c.CommFilePath)
+	}
+	c.signKey, c.redeemKeys, c.G, c.H = signKey, redeemKeys, G, H
+	c.keyVersion = keyVersion
+	c.keyFiles = fileStates
 	return nil
 }
 
-func (c *Server) ListenAndServe() error {
-	if len(c.signKey) == 0 {
+// keyFileStates returns the state of the files loadKeys reads. Files that
+// can't be read have a zero state.
+func (c *Server) keyFileStates() [3]keyFileState {
+	var states [3]keyFileState
+	for i, path := range []string{c.SignKeyFilePath, c.RedeemKeysFilePath, c.CommFilePath} {
+		if info, err := os.Stat(path); err == nil {
+			states[i] = keyFileState{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return states
+}
+
+// WatchKeyFile checks the key and commitment files every interval and reloads
+// them when one has changed since they were loaded, until ctx is cancelled. If
+// the new files can't be loaded, for example because the commitment doesn't
+// match the new key yet, the current keys stay in use and the load is retried
+// every interval, so a fix is picked up even if it doesn't change the file
+// state.
+func (c *Server) WatchKeyFile(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastErr string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current := c.keyFileStates()
+		c.keyLock.RLock()
+		loaded := c.keyFiles
+		c.keyLock.RUnlock()
+		if current == loaded {
+			continue
+		}
+		if err := c.loadKeys(); err != nil {
+			// only log when the failure changes, not on every retry
+			if err.Error() != lastErr {
+				errLog.Printf("WARNING: failed to reload keys, still using the previous key: %v", err)
+				lastErr = err.Error()
+			}
+			continue
+		}
+		lastErr = ""
+		errLog.Println("reloaded signing key")
+	}
+}
+
+// ListenAndServe accepts connections until ctx is cancelled, then waits up to
+// ShutdownGraceMs for the connections that are still being handled.
+func (c *Server) ListenAndServe(ctx context.Context) error {
+	c.keyLock.RLock()
+	noKey := len(c.signKey) == 0
+	c.keyLock.RUnlock()
+	if noKey {
 		return ErrNoSecretKey
 	}
 
@@ -182,6 +343,16 @@ func (c *Server) ListenAndServe() error {
 		metrics.RegisterAndListen(metricsAddr, errLog)
 	}()
 
+	return c.serve(ctx, listener)
+}
+
+func (c *Server) serve(ctx context.Context, listener *net.TCPListener) error {
+	// Closing the listener unblocks AcceptTCP below
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
 	// Log errors without killing the entire server
 	errorChannel := make(chan error)
 	go func() {
@@ -195,10 +366,14 @@ func (c *Server) ListenAndServe() error {
 
 	// how long to wait for temporary net errors
 	backoffDelay := 1 * time.Millisecond
+	var inflight sync.WaitGroup
 
 	for {
 		tcpConn, err := listener.AcceptTCP()
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
 			if netErr, ok := err.(net.Error); ok {
 				if netErr.Temporary() {
 					// let's wait
@@ -218,27 +393,52 @@ func (c *Server) ListenAndServe() error {
 		tcpConn.SetKeepAlive(true)
 		tcpConn.SetKeepAlivePeriod(1 * time.Minute)
 
+		inflight.Add(1)
 		go func() {
+			defer inflight.Done()
 			errorChannel <- c.handle(tcpConn)
 			tcpConn.Close()
 		}()
 	}
+
+	errLog.Printf("shutting down, waiting up to %dms for open connections", c.ShutdownGraceMs)
+	drained := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(drained)
+		// nothing sends errors once every handler has returned, even if
+		// that's after the grace period
+		close(errorChannel)
+	}()
+	select {
+	case <-drained:
+		return nil
+	case <-time.After(time.Duration(c.ShutdownGraceMs) * time.Millisecond):
+		return ErrShutdownTimeout
+	}
 }
 
 func main() {
 	var configFile string
 	var err error
-	srv := *DefaultServer
+	srv := newDefaultServer()
 
 	flag.StringVar(&configFile, "config", "", "local config file for development (overrides cli options)")
 	flag.StringVar(&srv.BindAddress, "addr", "127.0.0.1", "address to listen on")
 	flag.StringVar(&srv.SignKeyFilePath, "key", "", "path to the current secret key file for signing tokens")
 	flag.StringVar(&srv.RedeemKeysFilePath, "redeem_keys", "", "(optional) path to the file containing all other keys that are still used for validating redemptions")
 	flag.StringVar(&srv.CommFilePath, "comm", "", "path to the commitment file")
+	flag.StringVar(&srv.SigningAuditPath, "signing_audit_log", "", "(optional) path to an audit log of signed tokens, MAC'd with the key in $SIGNING_AUDIT_HMAC_KEY (overridden by $SIGNING_AUDIT_LOG_PATH)")
 	flag.IntVar(&srv.ListenPort, "p", 2416, "port to listen on")
 	flag.IntVar(&srv.MetricsPort, "m", 2417, "metrics port")
 	flag.IntVar(&srv.MaxTokens, "maxtokens", 100, "maximum number of tokens issued per request")
-	flag.StringVar(&srv.keyVersion, "keyversion", "1.0", "version sent to the client for choosing consistent key commitments for proof verification")
+	flag.IntVar(&srv.SignWorkers, "sign_workers", 1, "number of goroutines signing the tokens of one issue request (1 signs sequentially)")
+	flag.IntVar(&srv.ReadDeadlineMs, "read_deadline_ms", 100, "time in milliseconds allowed for reading a request from a connection (0 disables the deadline)")
+	flag.IntVar(&srv.WriteDeadlineMs, "write_deadline_ms", 0, "time in milliseconds allowed for handling a request and writing the response once it has been read (0 disables the deadline)")
+	flag.BoolVar(&srv.LogIncludeCaller, "log_include_caller", true, "prefix log lines with the file and line that wrote them (overridden by $LOG_INCLUDE_CALLER)")
+	flag.IntVar(&srv.ShutdownGraceMs, "shutdown_grace_ms", 30000, "time in milliseconds to wait for open connections on SIGTERM (overridden by $SHUTDOWN_GRACE_PERIOD, e.g. \"30s\")")
+	flag.IntVar(&srv.KeyReloadMs, "key_reload_ms", 10000, "how often in milliseconds to check the key and commitment files for changes (0 disables reloading)")
+	flag.StringVar(&srv.defaultKeyVersion, "keyversion", "1.0", "version sent to the client for choosing consistent key commitments for proof verification, unless the commitment file has a \"version\"")
 	flag.Parse()
 
 	if configFile != "" {
@@ -249,6 +449,30 @@ func main() {
 		}
 	}
 
+	if env := os.Getenv("LOG_INCLUDE_CALLER"); env != "" {
+		srv.LogIncludeCaller, err = strconv.ParseBool(env)
+		if err != nil {
+			errLog.Fatal(err)
+			return
+		}
+	}
+	if env := os.Getenv("SIGNING_AUDIT_LOG_PATH"); env != "" {
+		srv.SigningAuditPath = env
+	}
+	if env := os.Getenv("SHUTDOWN_GRACE_PERIOD"); env != "" {
+		grace, err := time.ParseDuration(env)
+		if err != nil {
+			errLog.Fatal(err)
+			return
+		}
+		srv.ShutdownGraceMs = int(grace / time.Millisecond)
+	}
+	if srv.LogIncludeCaller {
+		errLog.SetFlags(log.LstdFlags | log.Lshortfile)
+	} else {
+		errLog.SetFlags(log.LstdFlags)
+	}
+
 	if configFile == "" && (srv.SignKeyFilePath == "" || srv.CommFilePath == "") {
 		flag.Usage()
 		return
@@ -260,25 +484,29 @@ func main() {
 		return
 	}
 
-	// Get bytes for public commitment to private key
-	GBytes, HBytes, err := crypto.ParseCommitmentFile(srv.CommFilePath)
-	if err != nil {
-		errLog.Fatal(err)
+	btd.SignWorkers = srv.SignWorkers
+
+	if btd.SpentTokensErr != nil {
+		errLog.Fatal(btd.SpentTokensErr)
 		return
 	}
 
-	// Retrieve the actual elliptic curve points for the commitment
-	// The commitment should match the current key that is being used for
-	// signing
-	//
-	// We only support curve point commitments for P256-SHA256
-	srv.G, srv.H, err = crypto.RetrieveCommPoints(GBytes, HBytes, srv.signKey)
-	if err != nil {
-		errLog.Fatal(err)
-		return
+	if srv.SigningAuditPath != "" {
+		auditLog, err := btd.NewFileSigningAuditLogger(srv.SigningAuditPath, []byte(os.Getenv("SIGNING_AUDIT_HMAC_KEY")), maxAuditLogSize)
+		if err != nil {
+			errLog.Fatal(err)
+			return
+		}
+		defer auditLog.Close()
+		btd.SigningAudit = auditLog
 	}
 
-	err = srv.ListenAndServe()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if srv.KeyReloadMs > 0 {
+		go srv.WatchKeyFile(ctx, time.Duration(srv.KeyReloadMs)*time.Millisecond)
+	}
+	err = srv.ListenAndServe(ctx)
 
 	if err != nil {
 		errLog.Fatal(err)
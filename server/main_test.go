@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/privacypass/challenge-bypass-server"
+	"github.com/privacypass/challenge-bypass-server/crypto"
+	"github.com/privacypass/challenge-bypass-server/metrics"
+)
+
+// Opens a loopback TCP connection and returns both ends of it.
+func loopbackConns(t *testing.T) (server, client *net.TCPConn) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err = net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = listener.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, client
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+// Tests that a client writing slower than the read deadline is dropped and
+// counted as a deadline timeout rather than a connection error.
+func TestReadDeadlineTimeout(t *testing.T) {
+	srv := newDefaultServer()
+	srv.ReadDeadlineMs = 20
+
+	serverConn, clientConn := loopbackConns(t)
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	timeouts := counterValue(t, metrics.CounterDeadlineTimeout)
+	connErrors := counterValue(t, metrics.CounterConnErrors)
+
+	// the client only writes once the deadline has long passed
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		clientConn.Write([]byte(`{"bl_sig_req":""}`))
+	}()
+
+	err := srv.handle(serverConn)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected a timeout error, got: %v", err)
+	}
+	if got := counterValue(t, metrics.CounterDeadlineTimeout); got != timeouts+1 {
+		t.Errorf("deadline timeout counter is %v, expected %v", got, timeouts+1)
+	}
+	if got := counterValue(t, metrics.CounterConnErrors); got != connErrors {
+		t.Errorf("connection error counter changed from %v to %v", connErrors, got)
+	}
+}
+
+// Tests that an issuance whose response misses the write deadline is counted
+// as a deadline timeout and not as a successful issuance.
+func TestWriteDeadlineTimeout(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := priv.D.Bytes()
+	curveParams := &crypto.CurveParams{Curve: "p256", Hash: "sha256", Method: "increment"}
+	h2cObj, err := curveParams.GetH2CObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, G, err := crypto.NewRandomPoint(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	H := crypto.SignPoint(G, key)
+	_, P, _, err := crypto.CreateBlindToken(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := btd.BlindTokenRequest{Type: btd.ISSUE, Contents: [][]byte{P.Marshal()}}
+
+	serverConn, clientConn := loopbackConns(t)
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	timeouts := counterValue(t, metrics.CounterDeadlineTimeout)
+	successes := counterValue(t, metrics.CounterIssueSuccess)
+
+	// the deadline has passed by the time the response is written
+	serverConn.SetWriteDeadline(time.Now())
+
+	err = btd.HandleIssue(serverConn, req, key, "1.0", G, H, 1)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected a timeout error, got: %v", err)
+	}
+	if got := counterValue(t, metrics.CounterDeadlineTimeout); got != timeouts+1 {
+		t.Errorf("deadline timeout counter is %v, expected %v", got, timeouts+1)
+	}
+	if got := counterValue(t, metrics.CounterIssueSuccess); got != successes {
+		t.Errorf("issue success counter changed from %v to %v", successes, got)
+	}
+}
+
+// Tests that cancelling the context stops new connections but lets a request
+// that is already being handled write its response, and that serve leaves no
+// goroutines behind.
+func TestShutdownDrainsConnections(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	srv := newDefaultServer()
+	srv.ReadDeadlineMs = 300
+	srv.ShutdownGraceMs = 5000
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.serve(ctx, listener)
+	}()
+
+	request, err := json.Marshal(btd.BlindTokenRequest{Type: btd.REDEEM, Contents: [][]byte{[]byte("token")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := json.Marshal(btd.BlindTokenRequestWrapper{Request: request})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write(wrapped); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a half-close the server reads until its deadline, so the
+	// request is still in flight when the context is cancelled
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-served:
+		t.Fatalf("serve returned before the open connection finished: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr)); err == nil {
+		t.Error("listener still accepted connections after shutdown")
+	}
+
+	resp, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) == 0 {
+		t.Error("in-flight request did not get a response")
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("serve returned %v after draining", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > goroutines {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines still running after serve returned, expected %d", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Tests that serve gives up on connections that outlive the grace period.
+func TestShutdownGracePeriodExpires(t *testing.T) {
+	srv := newDefaultServer()
+	srv.ReadDeadlineMs = 1000
+	srv.ShutdownGraceMs = 20
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.serve(ctx, listener)
+	}()
+
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	if err := <-served; err != ErrShutdownTimeout {
+		t.Fatalf("expected ErrShutdownTimeout, got %v", err)
+	}
+}
+
+// writeKeyFiles writes a new P-256 signing key and a commitment to it with
+// the given key version into dir, and returns the key as loadKeys parses it.
+func writeKeyFiles(t *testing.T, dir, version string, modTime time.Time) []byte {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	curveParams := &crypto.CurveParams{Curve: "p256", Hash: "sha256", Method: "increment"}
+	h2cObj, err := curveParams.GetH2CObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, G, err := crypto.NewRandomPoint(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	H := crypto.SignPoint(G, priv.D.Bytes())
+	comm, err := json.Marshal(map[string]string{
+		"G":       base64.StdEncoding.EncodeToString(G.Marshal()),
+		"H":       base64.StdEncoding.EncodeToString(H.Marshal()),
+		"version": version,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commPath := filepath.Join(dir, "comm.json")
+	if err = ioutil.WriteFile(commPath, comm, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// make sure the change is visible even on filesystems with coarse mtimes
+	for _, path := range []string{keyPath, commPath} {
+		if err = os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return priv.D.Bytes()
+}
+
+func (c *Server) currentSignKey() []byte {
+	c.keyLock.RLock()
+	defer c.keyLock.RUnlock()
+	return c.signKey
+}
+
+func (c *Server) currentRedeemKeys() [][]byte {
+	c.keyLock.RLock()
+	defer c.keyLock.RUnlock()
+	return c.redeemKeys
+}
+
+// issueOne sends an issue request for a single token through handle and
+// returns the blinded point that was sent, the signed point received and the
+// key version of the response.
+func issueOne(t *testing.T, srv *Server) (*crypto.Point, *crypto.Point, string) {
+	curveParams := &crypto.CurveParams{Curve: "p256", Hash: "sha256", Method: "increment"}
+	h2cObj, err := curveParams.GetH2CObj()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, P, _, err := crypto.CreateBlindToken(h2cObj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := json.Marshal(btd.BlindTokenRequest{Type: btd.ISSUE, Contents: [][]byte{P.Marshal()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := json.Marshal(btd.BlindTokenRequestWrapper{Request: request})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := loopbackConns(t)
+	defer clientConn.Close()
+	go func() {
+		srv.handle(serverConn)
+		serverConn.Close()
+	}()
+	if _, err = clientConn.Write(wrapped); err != nil {
+		t.Fatal(err)
+	}
+	clientConn.CloseWrite()
+	resp, err := ioutil.ReadAll(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	respJson, err := base64.StdEncoding.DecodeString(string(resp))
+	if err != nil {
+		t.Fatalf("bad issue response %q: %v", resp, err)
+	}
+	var issued btd.IssuedTokenResponse
+	if err = json.Unmarshal(respJson, &issued); err != nil {
+		t.Fatal(err)
+	}
+	Q, err := crypto.BatchUnmarshalPoints(h2cObj.Curve(), issued.Sigs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return P, Q[0], issued.Version
+}
+
+// waitForSignKey waits for the watcher to load key as the signing key
+func waitForSignKey(t *testing.T, srv *Server, key []byte) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.Equal(srv.currentSignKey(), key) {
+		if time.Now().After(deadline) {
+			t.Fatal("new signing key was not loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// rotateRedeemKeys writes the current signing key file of srv, followed by
+// the PEM blocks in keep, as the redeem keys file. This is how an operator
+// keeps a replaced signing key valid for redemptions.
+func rotateRedeemKeys(t *testing.T, srv *Server, modTime time.Time, keep ...[]byte) []byte {
+	current, err := ioutil.ReadFile(srv.SignKeyFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redeem := bytes.Join(append([][]byte{current}, keep...), nil)
+	if err = ioutil.WriteFile(srv.RedeemKeysFilePath, redeem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(srv.RedeemKeysFilePath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	return current
+}
+
+// Tests that changed key files are picked up without a restart together with
+// their key version, that the redeem keys come only from the files and that
+// broken key files or an unchanged version leave the current key in place.
+func TestWatchKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	firstKey := writeKeyFiles(t, dir, "1.0", now.Add(-time.Hour))
+
+	srv := newDefaultServer()
+	srv.SignKeyFilePath = filepath.Join(dir, "key.pem")
+	srv.CommFilePath = filepath.Join(dir, "comm.json")
+	srv.RedeemKeysFilePath = filepath.Join(dir, "redeem.pem")
+	rotateRedeemKeys(t, srv, now.Add(-time.Hour))
+	if err := srv.loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.WatchKeyFile(ctx, 10*time.Millisecond)
+
+	rotateRedeemKeys(t, srv, now)
+	secondKey := writeKeyFiles(t, dir, "2.0", now)
+	waitForSignKey(t, srv, secondKey)
+
+	P, Q, version := issueOne(t, srv)
+	expected := crypto.SignPoint(P, secondKey)
+	if Q.X.Cmp(expected.X) != 0 || Q.Y.Cmp(expected.Y) != 0 {
+		t.Fatal("token was not signed with the reloaded key")
+	}
+	if version != "2.0" {
+		t.Fatalf("response has key version %q after the reload, expected 2.0", version)
+	}
+	if redeemKeys := srv.currentRedeemKeys(); len(redeemKeys) != 2 ||
+		!bytes.Equal(redeemKeys[0], secondKey) || !bytes.Equal(redeemKeys[1], firstKey) {
+		t.Fatal("redemption keys should be the new key followed by the moved key")
+	}
+
+	// dropping the first key from the redeem keys file revokes it
+	rotateRedeemKeys(t, srv, now.Add(time.Hour))
+	thirdKey := writeKeyFiles(t, dir, "3.0", now.Add(time.Hour))
+	waitForSignKey(t, srv, thirdKey)
+	if redeemKeys := srv.currentRedeemKeys(); len(redeemKeys) != 2 ||
+		!bytes.Equal(redeemKeys[0], thirdKey) || !bytes.Equal(redeemKeys[1], secondKey) {
+		t.Fatal("redemption keys should be exactly the keys in the files")
+	}
+
+	// a new commitment under the version clients already have is refused
+	writeKeyFiles(t, dir, "3.0", now.Add(2*time.Hour))
+	time.Sleep(100 * time.Millisecond)
+	if !bytes.Equal(srv.currentSignKey(), thirdKey) {
+		t.Fatal("a new key was loaded without a new key version")
+	}
+
+	// a key file that can't be parsed must not replace the working key
+	err := ioutil.WriteFile(srv.SignKeyFilePath, []byte("not a key"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := now.Add(3 * time.Hour)
+	if err = os.Chtimes(srv.SignKeyFilePath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !bytes.Equal(srv.currentSignKey(), thirdKey) {
+		t.Fatal("a broken key file replaced the signing key")
+	}
+
+	// fixing the files is picked up even if the mtime stays the same
+	fourthKey := writeKeyFiles(t, dir, "4.0", later)
+	waitForSignKey(t, srv, fourthKey)
+}
+
+// Tests that a reload is refused when the new commitment doesn't name its key
+// version, as clients would keep verifying against the old commitment.
+func TestLoadKeysRequiresVersion(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	firstKey := writeKeyFiles(t, dir, "", now.Add(-time.Hour))
+
+	srv := newDefaultServer()
+	srv.SignKeyFilePath = filepath.Join(dir, "key.pem")
+	srv.CommFilePath = filepath.Join(dir, "comm.json")
+	if err := srv.loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeKeyFiles(t, dir, "", now)
+	if err := srv.loadKeys(); err != ErrKeyVersionMissing {
+		t.Fatalf("expected ErrKeyVersionMissing, got %v", err)
+	}
+	if !bytes.Equal(srv.currentSignKey(), firstKey) {
+		t.Fatal("a commitment without a version replaced the signing key")
+	}
+
+	secondKey := writeKeyFiles(t, dir, "2.0", now.Add(time.Hour))
+	if err := srv.loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(srv.currentSignKey(), secondKey) {
+		t.Fatal("a commitment with a new version was not loaded")
+	}
+}
+
+// Tests that a signing key on a curve the server can't issue on is refused
+func TestLoadKeysUnsupportedCurve(t *testing.T) {
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newDefaultServer()
+	srv.SignKeyFilePath = filepath.Join(t.TempDir(), "key.pem")
+	srv.CommFilePath = "../testdata/test-p256-commitment"
+	err = ioutil.WriteFile(srv.SignKeyFilePath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.loadKeys(); err != ErrUnsupportedKeyCurve {
+		t.Fatalf("expected ErrUnsupportedKeyCurve, got %v", err)
+	}
+}
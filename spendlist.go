@@ -1,14 +1,39 @@
 package btd
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
 	"sync"
 
+	"github.com/prometheus/client_golang/prometheus"
 	boom "github.com/tylertreat/BoomFilters"
 )
 
+const (
+	defaultBloomCells    = 10000000
+	defaultBloomCellBits = 8
+	defaultBloomFPP      = 0.000001
+)
+
+var (
+	ErrInvalidBloomParams = errors.New("invalid bloom filter parameters")
+)
+
+// SpendList records redeemed tokens. The implementation backing SpentTokens
+// is chosen at build time, see newSpendList.
+type SpendList interface {
+	CheckToken(token []byte) bool
+	AddToken(token []byte) error
+	Reset()
+}
+
 type DoubleSpendList struct {
-	lock   sync.RWMutex
-	filter *boom.StableBloomFilter
+	lock      sync.RWMutex
+	filter    *boom.StableBloomFilter
+	count     uint
+	fillRatio prometheus.Gauge // set to count/cells on every change, if not nil; passes 1 once old tokens are evicted
 }
 
 // Amongst a profusion of bloom filter variants, this one at least uses a
@@ -17,8 +42,46 @@ type DoubleSpendList struct {
 // positive rate.
 func NewDoubleSpendList() *DoubleSpendList {
 	return &DoubleSpendList{
-		filter: boom.NewStableBloomFilter(10000000, 8, 0.000001),
+		filter: boom.NewStableBloomFilter(defaultBloomCells, defaultBloomCellBits, defaultBloomFPP),
+	}
+}
+
+// NewDoubleSpendListFromEnv sizes the filter from $BLOOM_CELLS (number of
+// cells), $BLOOM_K (bits per cell, 1-8) and $BLOOM_FPP (target false positive
+// rate), using the NewDoubleSpendList values for unset variables.
+func NewDoubleSpendListFromEnv() (*DoubleSpendList, error) {
+	cells, cellBits, fpp := uint64(defaultBloomCells), uint64(defaultBloomCellBits), defaultBloomFPP
+	var err error
+	if env := os.Getenv("BLOOM_CELLS"); env != "" {
+		cells, err = strconv.ParseUint(env, 10, 0)
+		if err != nil || cells == 0 {
+			return nil, fmt.Errorf("%w, BLOOM_CELLS: %q", ErrInvalidBloomParams, env)
+		}
 	}
+	if env := os.Getenv("BLOOM_K"); env != "" {
+		cellBits, err = strconv.ParseUint(env, 10, 8)
+		if err != nil || cellBits == 0 || cellBits > 8 {
+			return nil, fmt.Errorf("%w, BLOOM_K: %q", ErrInvalidBloomParams, env)
+		}
+	}
+	if env := os.Getenv("BLOOM_FPP"); env != "" {
+		fpp, err = strconv.ParseFloat(env, 64)
+		if err != nil || fpp <= 0 || fpp >= 1 {
+			return nil, fmt.Errorf("%w, BLOOM_FPP: %q", ErrInvalidBloomParams, env)
+		}
+	}
+	return &DoubleSpendList{
+		filter: boom.NewStableBloomFilter(uint(cells), uint8(cellBits), fpp),
+	}, nil
+}
+
+// Stats returns the number of cells in the filter, the number of tokens that
+// have been added since it was last reset and its asymptotic false positive
+// rate. Because the filter evicts old tokens, count/capacity can pass 1.
+func (d *DoubleSpendList) Stats() (capacity uint, count uint, fpRate float64) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.filter.Cells(), d.count, d.filter.FalsePositiveRate()
 }
 
 func (d *DoubleSpendList) CheckToken(token []byte) bool {
@@ -27,14 +90,23 @@ func (d *DoubleSpendList) CheckToken(token []byte) bool {
 	return d.filter.Test(token)
 }
 
-func (d *DoubleSpendList) AddToken(token []byte) {
+func (d *DoubleSpendList) AddToken(token []byte) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	d.filter.Add(token)
+	d.count++
+	if d.fillRatio != nil {
+		d.fillRatio.Set(float64(d.count) / float64(d.filter.Cells()))
+	}
+	return nil
 }
 
 func (d *DoubleSpendList) Reset() {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	d.filter.Reset()
+	d.count = 0
+	if d.fillRatio != nil {
+		d.fillRatio.Set(0)
+	}
 }
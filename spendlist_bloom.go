@@ -0,0 +1,29 @@
+//go:build !cuckoo
+
+package btd
+
+import (
+	"github.com/privacypass/challenge-bypass-server/metrics"
+)
+
+func init() {
+	metrics.GaugeDoubleSpendFilterType.Set(0)
+}
+
+func newSpendList() SpendList {
+	return NewDoubleSpendList()
+}
+
+// NewSpendListFromEnv returns the list the server records spent tokens in,
+// sized from the environment as described at NewDoubleSpendListFromEnv. Its
+// fill ratio is reported as the bloom_filter_fill_ratio metric. That counts
+// every token added since the last reset, so it keeps growing past 1 while
+// the stable bloom filter evicts old tokens to make room.
+func NewSpendListFromEnv() (SpendList, error) {
+	list, err := NewDoubleSpendListFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	list.fillRatio = metrics.GaugeBloomFillRatio
+	return list, nil
+}
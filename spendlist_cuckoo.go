@@ -0,0 +1,27 @@
+//go:build cuckoo
+
+package btd
+
+import (
+	"github.com/privacypass/challenge-bypass-server/metrics"
+)
+
+func init() {
+	metrics.GaugeDoubleSpendFilterType.Set(1)
+}
+
+func newSpendList() SpendList {
+	return NewCuckooDoubleSpendList()
+}
+
+// NewSpendListFromEnv returns the list the server records spent tokens in,
+// sized from the environment as described at NewCuckooDoubleSpendListFromEnv.
+// Its fill ratio is reported as the cuckoo_filter_fill_ratio metric.
+func NewSpendListFromEnv() (SpendList, error) {
+	list, err := NewCuckooDoubleSpendListFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	list.fillRatio = metrics.GaugeCuckooFillRatio
+	return list, nil
+}
@@ -1,18 +1,30 @@
 package btd
 
 import (
+	"errors"
 	"runtime"
 	"strconv"
 	"sync"
 	"testing"
 
-	boom "github.com/tylertreat/BoomFilters"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/privacypass/challenge-bypass-server/metrics"
 )
 
-func NewTestList() *DoubleSpendList {
-	return &DoubleSpendList{
-		filter: boom.NewStableBloomFilter(10000000, 8, 0.000001),
+func gaugeValue(t *testing.T, g prometheus.Gauge) float64 {
+	m := &dto.Metric{}
+	if err := g.Write(m); err != nil {
+		t.Fatal(err)
 	}
+	return m.GetGauge().GetValue()
+}
+
+// Returns the list selected by build tags, run with -tags cuckoo to test the
+// cuckoo filter backend
+func NewTestList() SpendList {
+	return newSpendList()
 }
 
 func BenchmarkFilterAdd(b *testing.B) {
@@ -80,3 +92,168 @@ func TestFilterEviction(t *testing.T) {
 		t.Error("abc should not have been evicted")
 	}
 }
+
+func TestCuckooRemoveToken(t *testing.T) {
+	f := NewCuckooDoubleSpendList()
+
+	f.AddToken([]byte("abc"))
+	f.AddToken([]byte("123"))
+	if !f.RemoveToken([]byte("abc")) {
+		t.Fatal("abc should have been removed")
+	}
+	if f.CheckToken([]byte("abc")) {
+		t.Error("abc shouldn't be in list after removal")
+	}
+	if !f.CheckToken([]byte("123")) {
+		t.Error("123 should still be in list")
+	}
+	if f.RemoveToken([]byte("abc")) {
+		t.Error("abc was removed twice")
+	}
+}
+
+// Tests that a full filter fails closed: it refuses new tokens and reports
+// every token as spent until it is reset.
+func TestCuckooFilterFull(t *testing.T) {
+	f := newCuckooDoubleSpendList(64)
+	fillRatio := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_fill_ratio"})
+	f.fillRatio = fillRatio
+	var added [][]byte
+	var err error
+	for i := 0; i < 1000; i++ {
+		token := []byte(strconv.Itoa(i))
+		if err = f.AddToken(token); err != nil {
+			break
+		}
+		added = append(added, token)
+	}
+	if err != ErrFilterFull {
+		t.Fatalf("expected a full filter, got %v", err)
+	}
+	capacity, count, full := f.Stats()
+	if capacity != 64 || !full {
+		t.Fatalf("expected a full filter with capacity 64, got capacity %d, full %v", capacity, full)
+	}
+	if ratio := gaugeValue(t, fillRatio); ratio != float64(count)/64 {
+		t.Errorf("fill ratio gauge is %v, expected %v", ratio, float64(count)/64)
+	}
+	for _, token := range added {
+		if !f.CheckToken(token) {
+			t.Errorf("%s is no longer reported as spent", token)
+		}
+	}
+	if !f.CheckToken([]byte("never added")) {
+		t.Error("a full filter accepted a new token")
+	}
+	if err = f.AddToken([]byte("never added")); err != ErrFilterFull {
+		t.Errorf("expected ErrFilterFull once full, got %v", err)
+	}
+
+	f.Reset()
+	if f.CheckToken([]byte("never added")) {
+		t.Error("filter still rejects tokens after a reset")
+	}
+	if ratio := gaugeValue(t, fillRatio); ratio != 0 {
+		t.Errorf("fill ratio gauge is %v after a reset, expected 0", ratio)
+	}
+}
+
+func TestCuckooDoubleSpendListFromEnv(t *testing.T) {
+	t.Setenv("CUCKOO_CAPACITY", "1000")
+	f, err := NewCuckooDoubleSpendListFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capacity, count, full := f.Stats(); capacity != 1000 || count != 0 || full {
+		t.Fatalf("expected an empty filter with capacity 1000, got capacity %d with %d tokens", capacity, count)
+	}
+
+	for _, env := range []string{"0", "many"} {
+		t.Setenv("CUCKOO_CAPACITY", env)
+		if _, err = NewCuckooDoubleSpendListFromEnv(); !errors.Is(err, ErrInvalidCuckooCapacity) {
+			t.Errorf("CUCKOO_CAPACITY=%s: expected ErrInvalidCuckooCapacity, got %v", env, err)
+		}
+	}
+}
+
+// Measures the false positive rate of a list holding 100k tokens. Filling the
+// stable bloom filter is slow, so this stays well below its 10M capacity.
+func falsePositiveRate(b *testing.B, f SpendList) {
+	for i := 0; i < 100000; i++ {
+		f.AddToken([]byte(strconv.Itoa(i)))
+	}
+	b.ResetTimer()
+	falsePositives := 0
+	for i := 0; i < b.N; i++ {
+		if f.CheckToken([]byte("absent-" + strconv.Itoa(i))) {
+			falsePositives++
+		}
+	}
+	b.ReportMetric(float64(falsePositives)/float64(b.N), "fp/op")
+}
+
+func BenchmarkFalsePositiveRateBloom(b *testing.B) {
+	falsePositiveRate(b, NewDoubleSpendList())
+}
+
+func BenchmarkFalsePositiveRateCuckoo(b *testing.B) {
+	falsePositiveRate(b, NewCuckooDoubleSpendList())
+}
+
+func TestDoubleSpendListFromEnv(t *testing.T) {
+	t.Setenv("BLOOM_CELLS", "1000")
+	t.Setenv("BLOOM_K", "4")
+	t.Setenv("BLOOM_FPP", "0.01")
+
+	f, err := NewDoubleSpendListFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillRatio := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_fill_ratio"})
+	f.fillRatio = fillRatio
+	globalRatio := gaugeValue(t, metrics.GaugeBloomFillRatio)
+	capacity, count, fpRate := f.Stats()
+	if capacity != 1000 || count != 0 {
+		t.Fatalf("expected an empty filter with 1000 cells, got %d cells and %d tokens", capacity, count)
+	}
+	if fpRate <= 0 || fpRate >= 1 {
+		t.Errorf("unexpected false positive rate %v", fpRate)
+	}
+
+	for i := 0; i < 10; i++ {
+		f.AddToken([]byte(strconv.Itoa(i)))
+	}
+	if _, count, _ = f.Stats(); count != 10 {
+		t.Fatalf("expected 10 tokens, got %d", count)
+	}
+	if ratio := gaugeValue(t, fillRatio); ratio != 0.01 {
+		t.Errorf("fill ratio gauge is %v, expected 0.01", ratio)
+	}
+	// only the server's list reports to the global metric
+	if ratio := gaugeValue(t, metrics.GaugeBloomFillRatio); ratio != globalRatio {
+		t.Errorf("global fill ratio changed from %v to %v", globalRatio, ratio)
+	}
+	f.Reset()
+	if _, count, _ = f.Stats(); count != 0 {
+		t.Fatalf("expected no tokens after a reset, got %d", count)
+	}
+}
+
+func TestDoubleSpendListFromEnvInvalid(t *testing.T) {
+	for _, env := range [][2]string{
+		{"BLOOM_CELLS", "0"},
+		{"BLOOM_CELLS", "many"},
+		{"BLOOM_K", "0"},
+		{"BLOOM_K", "9"},
+		{"BLOOM_FPP", "1.5"},
+		{"BLOOM_FPP", "0"},
+	} {
+		t.Run(env[0]+"="+env[1], func(t *testing.T) {
+			t.Setenv(env[0], env[1])
+			_, err := NewDoubleSpendListFromEnv()
+			if !errors.Is(err, ErrInvalidBloomParams) {
+				t.Fatalf("expected ErrInvalidBloomParams, got %v", err)
+			}
+		})
+	}
+}